@@ -5,19 +5,367 @@ package main
 import (
 	"bytes"
 	"flag"
+	"fmt"
 	"io"
 	"net"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/michaelmacinnis/summit/pkg/buffer"
+	"github.com/michaelmacinnis/summit/pkg/cast"
 	"github.com/michaelmacinnis/summit/pkg/comms"
 	"github.com/michaelmacinnis/summit/pkg/config"
+	"github.com/michaelmacinnis/summit/pkg/lexer"
 	"github.com/michaelmacinnis/summit/pkg/message"
+	"github.com/michaelmacinnis/summit/pkg/screen"
 	"github.com/michaelmacinnis/summit/pkg/terminal"
 )
 
-func resize(w io.Writer, buf *buffer.T, n int) {
+// Replay settings.
+const (
+	lines = 30 // Lines per second when replaying a raw capture.
+	skip  = 5  // Seconds skipped forward or back.
+)
+
+func describe(m *message.T) string {
+	if m == nil {
+		return "nil"
+	}
+
+	return m.String()
+}
+
+// fatal reports an error and waits for a key press so that the error
+// is visible before the window closes.
+func fatal(w io.Writer, keys <-chan *message.T, reason string) {
+	w.Write([]byte("summit: " + reason + "\r\nPress any key to close."))
+
+	<-keys
+}
+
+// capture prints the text on the screen of the session at path.
+func capture(path string) int {
+	m := request(path, message.Capture{})
+	if m == nil {
+		return 1
+	}
+
+	c, ok := message.As[*message.Captured](m)
+	if !ok {
+		println("expected captured message got", describe(m))
+
+		return 1
+	}
+
+	fmt.Println(c.Text)
+
+	return 0
+}
+
+// compress shortens pauses in events to at most limit seconds.
+func compress(events []cast.Event, limit float64) {
+	if limit <= 0 {
+		return
+	}
+
+	prev, shift := 0.0, 0.0
+
+	for i := range events {
+		gap := events[i].Time - prev
+		prev = events[i].Time
+
+		if gap > limit {
+			shift += gap - limit
+		}
+
+		events[i].Time -= shift
+	}
+}
+
+// list prints the detached sessions of the mux at path.
+func list(path string) int {
+	m := request(path, message.List{})
+	if m == nil {
+		return 1
+	}
+
+	ss, ok := message.As[*message.Sessions](m)
+	if !ok {
+		println("expected sessions message got", describe(m))
+
+		return 1
+	}
+
+	prefix := ""
+	if path != "" {
+		prefix = path + "-"
+	}
+
+	for _, s := range ss.Detached {
+		fmt.Printf("%s%s\t%s\n", prefix, s.ID, strings.Join(s.Args, " "))
+	}
+
+	return 0
+}
+
+// load reads the recording at path. Anything other than an asciicast
+// file is taken to be raw output and replayed a line at a time.
+func load(path string) (*cast.Header, []cast.Event, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	h, events, err := cast.Read(bytes.NewReader(b))
+	if err == nil {
+		compress(events, h.IdleTimeLimit)
+
+		return h, events, nil
+	} else if bytes.HasPrefix(b, []byte("{")) {
+		return nil, nil, err
+	}
+
+	h = &cast.Header{}
+	if ts := terminal.GetSize(); ts != nil {
+		h.Width, h.Height = int(ts.Cols), int(ts.Rows)
+	}
+
+	events = []cast.Event{}
+
+	for i, line := range bytes.SplitAfter(b, []byte("\n")) {
+		if len(line) > 0 {
+			events = append(events, cast.Event{Time: float64(i) / lines, Kind: cast.Output, Data: string(line)})
+		}
+	}
+
+	return h, events, nil
+}
+
+// replay plays the recording at path. Space pauses and resumes, period
+// steps while paused, + and - change the speed, the arrow keys (or h and
+// l) skip back and forward, and q quits.
+//
+//nolint:cyclop,funlen
+func replay(path string, speed float64) int {
+	h, events, err := load(path)
+	if err != nil {
+		println("failed to load recording:", err.Error())
+
+		return 1
+	}
+
+	restore, err := terminal.MakeRaw()
+	if err != nil {
+		println("failed to put terminal in raw mode:", err.Error())
+
+		return 1
+	}
+
+	defer restore()
+
+	keys := comms.Chunk(os.Stdin, message.PM)
+
+	// The screen is redrawn when the window changes size.
+	resized := make(chan struct{}, 1)
+	cleanup := terminal.OnResize(func(_ *terminal.Size) {
+		select {
+		case resized <- struct{}{}:
+		default:
+		}
+	})
+
+	defer cleanup()
+
+	// A model of the recorded screen for redrawing after a resize or
+	// a skip.
+	vt := screen.New(h.Height, h.Width)
+
+	next := 0 // Index of the next event.
+	paused := false
+	position := 0.0 // Seconds into the recording.
+	then := time.Now()
+
+	// Plays events up to position, writing output to w, if not nil.
+	advance := func(w io.Writer) {
+		for ; next < len(events) && events[next].Time <= position; next++ {
+			e := events[next]
+
+			switch e.Kind {
+			case cast.Output:
+				vt.Write([]byte(e.Data))
+
+				if w != nil {
+					w.Write([]byte(e.Data))
+				}
+
+			case cast.Resize:
+				cols, rows := 0, 0
+				if _, err := fmt.Sscanf(e.Data, "%dx%d", &cols, &rows); err == nil {
+					vt.Resize(rows, cols)
+				}
+			}
+		}
+	}
+
+	seek := func(t float64) {
+		if t < 0 {
+			t = 0
+		}
+
+		if t < position {
+			next = 0
+			vt = screen.New(h.Height, h.Width)
+		}
+
+		position = t
+
+		advance(nil)
+
+		os.Stdout.Write(vt.Render())
+	}
+
+	os.Stdout.Write([]byte("\x1b[H\x1b[2J"))
+
+	for {
+		now := time.Now()
+		if !paused {
+			position += now.Sub(then).Seconds() * speed
+		}
+
+		then = now
+
+		advance(os.Stdout)
+
+		if next == len(events) {
+			break
+		}
+
+		var timer <-chan time.Time
+		if !paused {
+			timer = time.After(time.Duration((events[next].Time - position) / speed * float64(time.Second)))
+		}
+
+		select {
+		case <-timer:
+
+		case <-resized:
+			os.Stdout.Write(vt.Render())
+
+		case m := <-keys:
+			if m == nil {
+				goto done
+			}
+
+			switch string(m.Bytes()) {
+			case " ":
+				paused = !paused
+
+			case ".":
+				if paused {
+					position = events[next].Time
+				}
+
+			case "+", "=":
+				speed *= 2
+
+			case "-":
+				speed /= 2
+
+			case "\x1b[C", "l":
+				seek(position + skip)
+
+			case "\x1b[D", "h":
+				seek(position - skip)
+
+			case "q", "\x03":
+				goto done
+			}
+		}
+	}
+
+done:
+	// Leave the terminal as it was found.
+	os.Stdout.Write([]byte("\x1b[0m\x1b[?25h\x1b[?1047l"))
+	os.Stdout.Write(message.CRLF)
+
+	return 0
+}
+
+// request sends c to the session or mux at path and returns the reply.
+// Errors, including those sent as a reply, are printed and nil returned.
+func request(path string, c message.Control) *message.T {
+	conn, err := net.Dial("unix", config.Socket())
+	if err != nil {
+		println("failed to connect to server:", err.Error())
+
+		return nil
+	}
+
+	defer conn.Close()
+
+	fromServer := comms.Chunk(conn, message.PM)
+
+	secret, ok := message.As[*message.Secret](<-fromServer)
+	if !ok {
+		println("expected secret message")
+
+		return nil
+	}
+
+	k := secret.Key
+
+	m := <-fromServer
+	if err := message.Compatible(m); err != nil {
+		println(err.Error())
+
+		return nil
+	}
+
+	conn.Write(k.Sign(message.NewHello().Bytes()))
+	route(conn, k, path)
+	conn.Write(k.Sign(c.Bytes()))
+
+	buf := buffer.New()
+
+	m = <-fromServer
+	for buf.Buffered(m) {
+		m = <-fromServer
+	}
+
+	if e, ok := message.As[*message.Error](m); ok {
+		println(e.Reason)
+
+		return nil
+	}
+
+	return m
+}
+
+// resolve returns the routing path for path, which may instead name a
+// mux or a session in one. Errors are printed and false returned.
+func resolve(path string) (string, bool) {
+	if strings.Trim(path, "-0123456789") == "" {
+		return path, true
+	}
+
+	m := request("", message.Resolve{Name: path})
+	if m == nil {
+		return "", false
+	}
+
+	c, ok := message.As[*message.Resolved](m)
+	if !ok {
+		println("expected resolved message got", describe(m))
+
+		return "", false
+	}
+
+	return c.Path, true
+}
+
+func resize(w io.Writer, k message.Key, chans *buffer.Channels, buf *buffer.T, n int) {
 	routing := buf.Routing()
 
 	size := len(routing) + n
@@ -25,11 +373,20 @@ func resize(w io.Writer, buf *buffer.T, n int) {
 		return
 	}
 
-	for _, b := range routing[:size] {
-		w.Write(b)
+	for _, b := range chans.Route(routing[:size]) {
+		w.Write(k.Sign(b))
 	}
 
-	w.Write(message.TerminalSize(terminal.GetSize()))
+	w.Write(k.Sign(message.TerminalSize{Size: terminal.GetSize()}.Bytes()))
+}
+
+// route writes the route for path.
+func route(w io.Writer, k message.Key, path string) {
+	for _, s := range strings.Split(path, "-") {
+		if s != "" {
+			w.Write(k.Sign(message.Pty{ID: s}.Bytes()))
+		}
+	}
 }
 
 func main() {
@@ -40,10 +397,59 @@ func main() {
 		}
 	}()
 
+	attach := flag.String("a", "", "attach to the detached session at routing path")
+	capturing := flag.String("capture", "", "print the screen of the session at routing path")
 	j := flag.String("e", "", "environment (as a JSON array)")
+	id := flag.String("id", "", "ID of the request for this window")
+	ls := flag.Bool("ls", false, "list detached sessions")
 	path := flag.String("p", "", "routing path")
+	recording := flag.String("replay", "", "replay a recording (asciicast or raw output)")
+	ro := flag.Bool("ro", false, "share read-only")
+	share := flag.String("share", "", "share the session at routing path")
+	speed := 1.0
+	flag.Func("speed", "replay speed, a positive `float` (default 1)", func(s string) error {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		} else if f <= 0 {
+			return fmt.Errorf("%s is not positive", s)
+		}
+
+		speed = f
+
+		return nil
+	})
+	wait := flag.Bool("w", false, "the request waits for this session to end")
 	config.Parse()
 
+	lexer.Limit = config.MaxMessage(lexer.Limit)
+
+	// Names are resolved to routing paths by the server.
+	for _, p := range []*string{attach, capturing, path, share} {
+		resolved, ok := resolve(*p)
+		if !ok {
+			rv = 1
+
+			return
+		}
+
+		*p = resolved
+	}
+
+	if *ls {
+		rv = list(*path)
+
+		return
+	} else if *capturing != "" {
+		rv = capture(*capturing)
+
+		return
+	} else if *recording != "" {
+		rv = replay(*recording, speed)
+
+		return
+	}
+
 	restore, err := terminal.MakeRaw()
 	if err != nil {
 		println("failed to put terminal in raw mode:", err.Error())
@@ -62,51 +468,78 @@ func main() {
 
 	defer c.Close()
 
-	fromServer := comms.Chunk(c)
-	fromTerminal := comms.Chunk(os.Stdin)
+	fromServer := comms.Chunk(c, message.PM)
+	fromTerminal := comms.Chunk(os.Stdin, message.PM)
 	toServer := c
 	toTerminal := os.Stdout
 
-	// Send routing.
-	for _, s := range strings.Split(*path, "-") {
-		if s != "" {
-			b := message.Pty(s)
+	// The server starts by sending the key for this connection.
+	m := <-fromServer
 
-			toServer.Write(b)
-		}
+	secret, ok := message.As[*message.Secret](m)
+	if !ok {
+		println("expected secret message got", describe(m))
+
+		return
+	}
+
+	k := secret.Key
+
+	// Followed by its hello.
+	m = <-fromServer
+	if err := message.Compatible(m); err != nil {
+		fatal(toTerminal, fromTerminal, err.Error())
+
+		rv = 1
+
+		return
 	}
 
-	// Send the command to run.
-	args, _ := config.Command()
-	toServer.Write(message.Run(args, config.Env(*j)))
+	toServer.Write(k.Sign(message.NewHello().Bytes()))
+
+	// Send the command to run or the session to attach to or share.
+	if *attach != "" {
+		route(toServer, k, *attach)
+		toServer.Write(k.Sign(message.Attach{}.Bytes()))
+	} else if *share != "" {
+		route(toServer, k, *share)
+		toServer.Write(k.Sign(message.Share{ReadOnly: *ro}.Bytes()))
+	} else {
+		route(toServer, k, *path)
+
+		args, _ := config.Command()
+		toServer.Write(k.Sign(message.Run{Args: args, Env: config.Env(*j), ID: *id, Wait: *wait}.Bytes()))
+	}
 
 	buf := buffer.New()
+	chans := buffer.NewChannels()
 
 	// Wait for started message.
-	m := <-fromServer
+	m = <-fromServer
 	for buf.Buffered(m) {
 		m = <-fromServer
 	}
 
-	if !m.IsStarted() {
-		s := "nil"
-		if m != nil {
-			s = m.String()
-		}
+	if e, ok := message.As[*message.Error](m); ok {
+		fatal(toTerminal, fromTerminal, e.Reason)
+
+		rv = 1
 
-		println("expected started message got", s)
+		return
+	} else if !m.IsAttached() && !m.IsStarted() {
+		println("expected started message got", describe(m))
 
 		return
 	}
 
 	// Send terminal size.
-	resize(toServer, buf, 0)
+	resize(toServer, k, chans, buf, 0)
 
 	// Continue to send terminal size changes.
 	// These notifications are converted to look like terminal input so
 	// that they are not interleaved with other output when writing.
 	cleanup := terminal.OnResize(func(ts *terminal.Size) {
-		fromTerminal <- message.Raw(message.TerminalSize(ts))
+		fromTerminal <- message.Raw(k.Sign(message.TerminalSize{Size: ts}.Bytes()))
 	})
 
 	defer cleanup()
@@ -116,42 +549,69 @@ func main() {
 
 	for {
 		var f io.Writer
-		var m *message.T
 
-		select {
-		case m = <-fromTerminal:
-			if m == nil {
-				goto done
+		// Keys, and resizes, go ahead of output from the server.
+		m, _, input := comms.Prefer(fromTerminal, fromServer)
+		if m == nil {
+			goto done
+		}
+
+		if input {
+			// Everything typed or pasted, including anything that
+			// looks like a control message, is sent as quoted text.
+			if !k.Verify(m) || !m.Is(message.Command) {
+				// Except when read-only. Then ^] closes the window.
+				if *ro {
+					if bytes.IndexByte(m.Bytes(), '\x1d') >= 0 {
+						goto done
+					}
+
+					continue
+				}
+
+				m = message.New(message.Text, message.Quote(m.Original()))
 			}
 
 			f = toServer
 
 			// Send routing information.
-			for _, b := range buf.Routing() {
-				toServer.Write(b)
+			for _, b := range chans.Route(buf.Routing()) {
+				toServer.Write(k.Sign(b))
 			}
-
-		case m = <-fromServer:
-			if m == nil {
-				goto done
+		} else {
+			if !k.Verify(m) {
+				continue
 			}
 
 			if buf.Buffered(m) {
 				continue
 			}
 
-			if m.Is(message.Command) {
-				if m.IsStarted() {
+			c, err := m.Decode()
+			if err != nil {
+				println("dropping message from server:", err.Error())
+
+				continue
+			}
+
+			if c != nil {
+				switch c := c.(type) {
+				case *message.Error:
+					toTerminal.Write([]byte("summit: " + c.Reason))
+					toTerminal.Write(message.CRLF)
+
+				case *message.Started:
 					running++
-				} else if m.IsStatus() {
+
+				case *message.Status:
 					running--
 
 					if running == 0 {
-						rv = m.Status()
+						rv = c.Status
 						return
 					}
 
-					resize(toServer, buf, -1)
+					resize(toServer, k, chans, buf, -1)
 				}
 
 				// Unexpected message. Don't send to terminal.
@@ -159,7 +619,7 @@ func main() {
 			}
 
 			f = toTerminal
-
+			m = message.New(message.Text, message.Unquote(m.Bytes()))
 		}
 
 		s := m.Bytes()
@@ -0,0 +1,105 @@
+// Released under an MIT license. See LICENSE.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/michaelmacinnis/summit/pkg/cast"
+)
+
+func TestCompress(t *testing.T) {
+	tests := []struct {
+		name  string
+		limit float64
+		in    []float64
+		want  []float64
+	}{
+		{"no limit", 0, []float64{0, 5, 20}, []float64{0, 5, 20}},
+		{"short gaps", 2, []float64{0.5, 1, 2.5}, []float64{0.5, 1, 2.5}},
+		{"first gap", 2, []float64{10, 11}, []float64{2, 3}},
+		{"long gaps", 2, []float64{1, 6, 7, 20}, []float64{1, 3, 4, 6}},
+	}
+
+	for _, test := range tests {
+		events := make([]cast.Event, len(test.in))
+		for i, at := range test.in {
+			events[i].Time = at
+		}
+
+		compress(events, test.limit)
+
+		for i, e := range events {
+			if e.Time != test.want[i] {
+				t.Errorf("%s: event %d at %v, want %v", test.name, i, e.Time, test.want[i])
+			}
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	dir := t.TempDir()
+
+	asciicast := write(t, dir, "cast",
+		"{\"version\": 2, \"width\": 100, \"height\": 30, \"idle_time_limit\": 1}\n"+
+			"[0.5, \"o\", \"a\"]\n[5.5, \"o\", \"b\"]\n")
+
+	h, events, err := load(asciicast)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.Width != 100 || h.Height != 30 {
+		t.Errorf("got %dx%d, want 100x30", h.Width, h.Height)
+	}
+
+	if len(events) != 2 || events[0].Data != "a" || events[1].Data != "b" {
+		t.Fatalf("got events %+v", events)
+	}
+
+	if events[1].Time != 1.5 {
+		t.Errorf("idle time not limited: second event at %v, want 1.5", events[1].Time)
+	}
+
+	// Anything else is raw output, replayed a line at a time.
+	raw := write(t, dir, "raw", "$ ls\r\nfile\r\n$ ")
+
+	_, events, err = load(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"$ ls\r\n", "file\r\n", "$ "}
+	if len(events) != len(want) {
+		t.Fatalf("got events %+v, want %q", events, want)
+	}
+
+	for i, e := range events {
+		if e.Kind != cast.Output || e.Data != want[i] || e.Time != float64(i)/lines {
+			t.Errorf("event %d: got %+v, want %q at %v", i, e, want[i], float64(i)/lines)
+		}
+	}
+
+	// A broken asciicast file isn't replayed as raw output.
+	broken := write(t, dir, "broken", "{\"version\": 1}\n")
+	if _, _, err := load(broken); err == nil {
+		t.Error("expected an error for a broken asciicast file")
+	}
+
+	if _, _, err := load(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected an error for a missing file")
+	}
+}
+
+func write(t *testing.T, dir, name, s string) string {
+	t.Helper()
+
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(s), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
@@ -3,36 +3,478 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"net"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/michaelmacinnis/summit/pkg/buffer"
 	"github.com/michaelmacinnis/summit/pkg/comms"
 	"github.com/michaelmacinnis/summit/pkg/config"
+	"github.com/michaelmacinnis/summit/pkg/lexer"
 	"github.com/michaelmacinnis/summit/pkg/message"
+	"github.com/michaelmacinnis/summit/pkg/screen"
 	"github.com/michaelmacinnis/summit/pkg/terminal"
 )
 
+// Control is how a session takes requests made over the mux's control
+// socket.
+type Control struct {
+	done     chan struct{} // Closed when the session ends.
+	k        message.Key   // The key for the hop to the session's program.
+	requests chan *Request
+}
+
+// Controls holds the Control for each session, by session ID.
+type Controls struct {
+	sync.Mutex
+
+	sessions map[string]*Control
+}
+
+// Detached holds the command for each session detached from its
+// terminal, by session ID.
+type Detached struct {
+	sync.Mutex
+
+	args map[string][]string
+}
+
+// Flow is whether whatever runs this mux grants credit. Its hello says.
+type Flow struct {
+	sync.Mutex
+
+	decided chan struct{} // Closed once a hello has said.
+	granted bool
+}
+
+// Request is a request for a new window made over the control socket.
+type Request struct {
+	m   *message.T
+	out chan [][]byte // Replies to the requester.
+	run *message.Run
+}
+
 type Status struct {
-	n    int
-	pty  string
-	rv   int
-	term string
+	n     int
+	pty   string
+	rv    int
+	terms []string
+}
+
+// Viewer is a terminal that a session is shown on.
+type Viewer struct {
+	credit   int
+	readonly bool
+	size     *terminal.Size
+	term     *message.T
 }
 
+// Viewers holds the terminals that a session is shown on, by terminal ID.
+type Viewers map[string]*Viewer
+
+// Waiter is where replies to a request for a new window go.
+type Waiter struct {
+	session bool          // Set if also waiting for the session to end.
+	to      chan [][]byte // The program or, if made over the control socket, the requester.
+}
+
+// Exit status when interrupted while waiting for a requested session.
+const interrupted = 130
+
+// Time to wait for a reply to a request for a new window.
+const replywait = 10 * time.Second
+
+// Time to wait for the hello that says whether credit is granted.
+const hellowait = 5 * time.Second
+
+// Bytes of output kept for a detached session.
+const backlogsz = 65536
+
 //nolint:gochecknoglobals
 var (
-	debug = true
-	label = "unknown"
+	controls = &Controls{sessions: map[string]*Control{}}
+	debug    = true
+	detached = &Detached{args: map[string][]string{}}
+	flow     = &Flow{decided: make(chan struct{})}
+	label    = "unknown"
+	name     = "" // What this mux is called in routing paths.
+	prefix   = "" // The routing path of the session this mux runs in, if known.
+	socket   = "" // The path to this mux's control socket.
 )
 
+// Errors returned by await.
+var (
+	errInterrupted = errors.New("interrupted")
+	errNoReply     = errors.New("no reply to request for a new window")
+)
+
+// Wait, on r, for the reply to the request with the given ID and, if
+// asked to, for the requested session to end. Returns the session's
+// status. When r is the terminal, an interrupt typed while waiting gives
+// up.
+func await(r io.Reader, c message.Carrier, tty bool, k message.Key, id string, wait bool) (int, error) {
+	if tty {
+		restore, err := terminal.MakeRaw()
+		if err != nil {
+			return 1, err
+		}
+
+		defer restore()
+	}
+
+	in := comms.Chunk(r, c)
+	timeout := time.After(replywait)
+
+	for {
+		select {
+		case m, ok := <-in:
+			if !ok {
+				return 1, errNoReply
+			}
+
+			if m.Is(message.Text) {
+				if bytes.IndexByte(m.Bytes(), '\x03') >= 0 {
+					return interrupted, errInterrupted
+				}
+			} else if k.Verify(m) && replied(m) == id {
+				c, _ := m.Decode()
+
+				switch c := c.(type) {
+				case *message.Ack:
+					if !wait {
+						return 0, nil
+					}
+
+					timeout = nil
+
+				case *message.Error:
+					return 1, errors.New(c.Reason)
+
+				case *message.Status:
+					return c.Status, nil
+				}
+			}
+
+		case <-timeout:
+			return 1, errNoReply
+		}
+	}
+}
+
+// bypass replaces this mux with the program in args. It returns only on
+// failure.
+func bypass(args []string) error {
+	path, err := exec.LookPath(args[0])
+	if err != nil {
+		return err
+	}
+
+	return syscall.Exec(path, args, os.Environ())
+}
+
+// The hello a session sends in reply to a nested mux. Credit is only
+// offered if this mux is granted it, as it is only passed on.
+func hello() message.Hello {
+	h := message.NewHello()
+	if flow.Granted() {
+		return h
+	}
+
+	h.Capabilities = []string{}
+	for _, c := range message.Capabilities {
+		if c != "credit" {
+			h.Capabilities = append(h.Capabilities, c)
+		}
+	}
+
+	return h
+}
+
+// Take requests for new windows, from the programs in this mux's
+// sessions, on l.
+func listen(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return // Closed as the mux exits.
+		}
+
+		go serve(conn)
+	}
+}
+
 func logf(out chan [][]byte, format string, i ...interface{}) {
 	if debug {
-		out <- [][]byte{message.Log(label+": "+format, i...).Bytes()}
+		out <- [][]byte{message.Logf(label+": "+format, i...).Bytes()}
+	}
+}
+
+// Copy stdin and stdout to and from the resumable mux listening on the
+// socket at path.
+func relay(path string) error {
+	c, err := net.Dial("unix", path)
+	if err != nil {
+		return err
 	}
+
+	go func() {
+		_, _ = io.Copy(c, os.Stdin) // Best effort.
+		c.Close()
+	}()
+
+	_, err = io.Copy(os.Stdout, c)
+
+	return err
+}
+
+// replied returns the ID of the request for a new window that m is the
+// reply to, if any.
+func replied(m *message.T) string {
+	c, _ := m.Decode()
+
+	switch c := c.(type) {
+	case *message.Ack:
+		return c.ID
+
+	case *message.Error:
+		return c.ID
+
+	case *message.Status:
+		return c.ID
+	}
+
+	return ""
+}
+
+// Carry the hop to our parent in a reliable stream that survives the
+// loss of stdin and stdout and can be resumed over connections to the
+// socket at path.
+func resumable(path string) (*comms.Reliable, error) {
+	os.Remove(path)
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	// Writing to a broken pipe should fail, not kill the mux.
+	signal.Ignore(syscall.SIGPIPE)
+
+	r := comms.NewReliable()
+
+	attach := func(t io.ReadWriteCloser) {
+		if err := r.Attach(t); err != nil {
+			println("hop failed:", err.Error())
+		}
+	}
+
+	go attach(comms.Join(os.Stdin, os.Stdout))
+
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				println(err.Error())
+
+				return
+			}
+
+			go attach(c)
+		}
+	}()
+
+	return r, nil
+}
+
+// Pass the request on conn to the session whose program signed it.
+func serve(conn net.Conn) {
+	m := <-comms.Chunk(conn, message.PM)
+
+	r, ok := message.As[*message.Run](m)
+	if !ok || r.ID == "" {
+		conn.Close()
+
+		return
+	}
+
+	c := controls.Find(m)
+	if c == nil {
+		conn.Close()
+
+		return
+	}
+
+	out := comms.Write(conn, c.k, message.PM)
+
+	select {
+	case c.requests <- &Request{m: m, out: out, run: r}:
+	case <-c.done:
+		out <- [][]byte{message.Error{Reason: "session has ended", ID: r.ID}.Bytes()}
+		close(out)
+	}
+}
+
+// Add registers c as how the session id takes requests.
+func (cs *Controls) Add(id string, c *Control) {
+	cs.Lock()
+	defer cs.Unlock()
+
+	cs.sessions[id] = c
+}
+
+// Find returns the Control for the session whose program signed m.
+func (cs *Controls) Find(m *message.T) *Control {
+	if !m.Is(message.Command) {
+		return nil
+	}
+
+	cs.Lock()
+	defer cs.Unlock()
+
+	for _, c := range cs.sessions {
+		if c.k.Verify(m) {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// Remove forgets how the session id takes requests.
+func (cs *Controls) Remove(id string) {
+	cs.Lock()
+	defer cs.Unlock()
+
+	delete(cs.sessions, id)
+}
+
+func (d *Detached) Add(id string, args []string) {
+	d.Lock()
+	defer d.Unlock()
+
+	d.args[id] = args
+}
+
+func (d *Detached) List() []message.Session {
+	d.Lock()
+	defer d.Unlock()
+
+	ss := []message.Session{}
+	for id, args := range d.args {
+		ss = append(ss, message.Session{ID: id, Args: args})
+	}
+
+	sort.Slice(ss, func(i, j int) bool {
+		return ss[i].ID < ss[j].ID
+	})
+
+	return ss
+}
+
+func (d *Detached) Remove(id string) {
+	d.Lock()
+	defer d.Unlock()
+
+	delete(d.args, id)
+}
+
+// Granted returns true if credit is granted.
+func (f *Flow) Granted() bool {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.granted
+}
+
+// Set records whether credit is granted.
+func (f *Flow) Set(granted bool) {
+	f.Lock()
+	defer f.Unlock()
+
+	f.granted = granted
+	f.decide()
+}
+
+// Wait waits, for at most d, until it is known whether credit is granted.
+// If it isn't known by then, as when no hello will come, it isn't, and
+// later waits return at once.
+func (f *Flow) Wait(d time.Duration) {
+	select {
+	case <-f.decided:
+	case <-time.After(d):
+		f.Lock()
+		f.decide()
+		f.Unlock()
+	}
+}
+
+// decide is called with f locked.
+func (f *Flow) decide() {
+	select {
+	case <-f.decided:
+	default:
+		close(f.decided)
+	}
+}
+
+// Blocked returns true if any viewer is out of credit.
+func (vs Viewers) Blocked() bool {
+	for _, v := range vs {
+		if v.credit <= 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Size returns the largest size that fits on every viewer or nil if no
+// viewer has reported its size.
+func (vs Viewers) Size() *terminal.Size {
+	size := (*terminal.Size)(nil)
+
+	for _, v := range vs {
+		if v.size == nil {
+			continue
+		} else if size == nil {
+			size = &terminal.Size{Rows: v.size.Rows, Cols: v.size.Cols}
+		}
+
+		if v.size.Rows < size.Rows {
+			size.Rows = v.size.Rows
+		}
+
+		if v.size.Cols < size.Cols {
+			size.Cols = v.size.Cols
+		}
+	}
+
+	return size
+}
+
+// Terms returns the ID of each viewer's terminal, in order.
+func (vs Viewers) Terms() []string {
+	ids := make([]string, 0, len(vs))
+	for id := range vs {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	return ids
 }
 
 func session(id string, in chan *message.T, out chan [][]byte, statusq chan *Status) {
@@ -48,29 +490,98 @@ func session(id string, in chan *message.T, out chan [][]byte, statusq chan *Sta
 
 	term := <-in
 
-	logf(out, "[%s] got terminal id %s:%s", id, term.Command(), term.Term())
+	t, ok := message.As[*message.Term](term)
+	if !ok {
+		logf(out, "[%s] error: expected terminal id got %v", id, term)
+
+		return
+	}
+
+	logf(out, "[%s] got terminal id %s", id, t.ID)
 
 	// Second message should be the command, environment, and window size.
 	m := <-in
-	args := m.Args()
+
+	r, ok := message.As[*message.Run](m)
+	if !ok {
+		logf(out, "[%s] error: expected command got %v", id, m)
+
+		return
+	}
+
+	args := r.Args
 
 	logf(out, "[%s] sending new pty id", id)
-	out <- [][]byte{term.Bytes(), message.Pty(id), message.Started()}
+	out <- [][]byte{term.Bytes(), message.Pty{ID: id}.Bytes(), message.Started{Name: name}.Bytes()}
 
 	cmd := exec.Command(args[0], args[1:]...) //nolint:gosec
 
-	cmd.Env = m.Env()
-	cmd.Dir = wd(cmd.Env)
+	// The hop between this mux and the program gets its own key.
+	k := message.NewKey()
+
+	cmd.Env = config.Setenv(r.Env, "SUMMIT_KEY", k.String())
+	if socket != "" {
+		cmd.Env = config.Setenv(cmd.Env, "SUMMIT_CONTROL", socket)
+	}
+
+	// Where the program is, for prompts and scripts. A nested mux
+	// started from here builds on the route.
+	route := id
+	if prefix != "" {
+		route = prefix + "-" + id
+	}
+
+	cmd.Env = config.Setenv(cmd.Env, "SUMMIT_DEPTH", strconv.Itoa(strings.Count(route, "-")+1))
+	cmd.Env = config.Setenv(cmd.Env, "SUMMIT_LABEL", label)
+	cmd.Env = config.Setenv(cmd.Env, "SUMMIT_PTY", id)
+	cmd.Env = config.Setenv(cmd.Env, "SUMMIT_ROUTE", route)
+	cmd.Dir = config.Getenv(cmd.Env, "PWD", "")
+
+	// A session whose environment asks for it is detached, instead of
+	// hung up, when its terminal goes away.
+	detachable := config.Getenv(cmd.Env, "SUMMIT_DETACH", "") != ""
+
+	// And keeps a model of its screen if asked to.
+	modeled := config.Getenv(cmd.Env, "SUMMIT_SCREEN", "") != ""
+
+	// As is the carrier, if the program's environment selects one.
+	c, err := message.ParseCarrier(config.Getenv(cmd.Env, "SUMMIT_CARRIER", message.PM.String()))
+	if err != nil {
+		logf(out, "[%s] error: %s", id, err.Error())
+	}
 
 	// Third message should be the terminal size.
-	m = <-in
-	ts := m.TerminalSize()
+	ts := (*terminal.Size)(nil)
+	if c, ok := message.As[*message.TerminalSize](<-in); ok {
+		ts = c.Size
+	}
+
+	// The key is a secret.
+	logf(out, "[%s] launching %#v (%#v)", id, args, config.Unsetenv(cmd.Env, "SUMMIT_KEY"))
 
-	logf(out, "[%s] launching %#v (%#v)", id, args, cmd.Env)
+	// Messages this session may send to each viewer before it must
+	// wait for credit. Output forwarded from a nested mux is credited
+	// to its sessions.
+	viewers := Viewers{t.ID: {credit: message.Window, size: ts, term: term}}
 
 	// Always send a status message on completion.
 	defer func() {
-		statusq <- &Status{0, id, cmd.ProcessState.ExitCode(), term.Term()}
+		detached.Remove(id)
+
+		// A nested mux must hear that a detached session has ended.
+		terms := viewers.Terms()
+		if len(terms) == 0 {
+			terms = []string{t.ID}
+		}
+
+		// Credit, for one, may still be on its way. It is dropped
+		// until the stream is closed.
+		go func() {
+			for range in {
+			}
+		}()
+
+		statusq <- &Status{0, id, cmd.ProcessState.ExitCode(), terms}
 	}()
 
 	f, err := terminal.StartWithSize(cmd, ts)
@@ -87,17 +598,202 @@ func session(id string, in chan *message.T, out chan [][]byte, statusq chan *Sta
 		_ = f.Close() // Best effort.
 	}()
 
+	backlog := []byte{}
+
+	// The screen, as the program has drawn it, if modeled.
+	vt := (*screen.T)(nil)
+	if modeled {
+		vt = screen.New(0, 0)
+		if ts != nil {
+			vt.Resize(int(ts.Rows), int(ts.Cols))
+		}
+	}
+
+	down := buffer.NewChannels()
 	dst := buffer.New(term)
-	fromProgram := comms.Chunk(f)
+	fromProgram := make(chan *message.T)
+	reading := fromProgram
 	fromTerminal := in
-	nested := 0
-	src := buffer.New(term, message.Raw(message.Pty(id)))
-	toProgram := comms.Write(f)
+	nested := map[string][][]byte{} // Routes to the sessions of a nested mux.
+	refused := false
+	src := buffer.New(term, message.From(message.Pty{ID: id}))
+	toProgram := comms.Write(f, k, c)
 	toTerminal := out
+	up := buffer.NewChannels()
+	waits := map[string]*Waiter{} // Requests for new windows, by ID.
+
+	// Requests made over the control socket and signed with this
+	// session's key.
+	requests := make(chan *Request)
+	quit := make(chan struct{})
+
+	controls.Add(id, &Control{done: quit, k: k, requests: requests})
+
+	// Requests are taken along with the program's output, behind input.
+	// Each is announced by asking, so that an idle program doesn't hold
+	// it up, and then handed over on asked.
+	asked := make(chan *Request)
+	asking := message.New(message.Text, nil)
+
+	go func() {
+		defer close(fromProgram)
+
+		output := comms.Chunk(f, c)
+
+		for {
+			select {
+			case m, ok := <-output:
+				if !ok {
+					return
+				}
+
+				select {
+				case fromProgram <- m:
+				case <-quit:
+					return
+				}
+
+			case r := <-requests:
+				select {
+				case fromProgram <- asking:
+					asked <- r
+				case <-quit:
+					r.out <- [][]byte{message.Error{Reason: "session has ended", ID: r.run.ID}.Bytes()}
+					close(r.out)
+
+					return
+				}
+
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	defer func() {
+		controls.Remove(id)
+		close(quit)
+
+		// Requesters still waiting will get no reply.
+		for _, w := range waits {
+			if w.to != toProgram {
+				close(w.to)
+			}
+		}
+	}()
+
+	own := len(src.Routing())
+
+	// The viewer, if any, on the terminal at the start of routing. The
+	// first session in a nested mux doesn't know the ID of its own
+	// terminal so anything from an unknown terminal is from that one.
+	from := func(routing [][]byte) (string, *Viewer) {
+		c, _ := message.As[*message.Term](message.Raw(routing[0]))
+		if c != nil && viewers[c.ID] != nil {
+			return c.ID, viewers[c.ID]
+		} else if t.ID == "" {
+			return "", viewers[""]
+		}
+
+		return "", nil
+	}
+
+	// Sizes the pty to fit every viewer.
+	resize := func() {
+		size := viewers.Size()
+		if size == nil {
+			return
+		}
+
+		if err := terminal.SetSize(f, size); err != nil {
+			logf(out, "[%s] error: setting size: %s", id, err.Error())
+		}
+
+		if vt != nil {
+			vt.Resize(int(size.Rows), int(size.Cols))
+		}
+	}
+
+	// Makes the terminal at the start of routing this session's own.
+	retarget := func(routing [][]byte) {
+		c, ok := message.As[*message.Term](message.Raw(routing[0]))
+		if !ok {
+			return
+		}
+
+		v := viewers[c.ID]
+		if v == nil {
+			v = &Viewer{credit: message.Window, term: message.Raw(routing[0])}
+		}
+
+		delete(viewers, t.ID)
+
+		t = c
+		term = v.term
+		src.Reprefix(term, message.From(message.Pty{ID: id}))
+
+		viewers[t.ID] = v
+	}
+
+	// Sends the reply to an attach or share request along with what
+	// the new viewer has missed.
+	welcome := func(v *Viewer) {
+		bs := [][]byte{v.term.Bytes(), message.Pty{ID: id}.Bytes(), message.Attached{}.Bytes()}
+
+		missed := []byte(nil)
+		if vt != nil {
+			missed = message.Quote(vt.Render())
+		} else if len(backlog) > 0 {
+			missed, backlog = backlog, []byte{}
+		}
+
+		// Like output, what was missed is text and takes credit.
+		if missed != nil {
+			bs = append(bs, missed)
+
+			if flow.Granted() {
+				if v.credit--; viewers.Blocked() {
+					reading = nil
+				}
+			}
+		}
+
+		toTerminal <- bs
+	}
+
+	// Sends a request made over the control socket, as if made by the
+	// program itself, to this session's terminal.
+	request := func(r *Request) {
+		if len(viewers) == 0 {
+			r.out <- [][]byte{message.Error{Reason: "no window for session " + id, ID: r.run.ID}.Bytes()}
+			close(r.out)
+
+			return
+		}
+
+		waits[r.run.ID] = &Waiter{session: r.run.Wait, to: r.out}
+
+		route := [][]byte{term.Bytes(), message.Pty{ID: id}.Bytes()}
+
+		toTerminal <- append(up.Route(route), r.m.Bytes())
+	}
+
+	// Output isn't read until it is known whether it must wait for
+	// credit. A nested mux on a terminal hears soon after it starts.
+	flow.Wait(hellowait)
 
 	for {
-		select {
-		case m, ok := <-fromTerminal:
+		// Input, including resizes and credit, goes ahead of output
+		// and requests made over the control socket.
+		m, ok, input := comms.Prefer(fromTerminal, reading)
+
+		if !input && m == asking {
+			request(<-asked)
+
+			continue
+		}
+
+		if input {
 			if !ok || m == nil {
 				goto done
 			}
@@ -107,43 +803,291 @@ func session(id string, in chan *message.T, out chan [][]byte, statusq chan *Sta
 			}
 
 			routing := dst.Routing()
-			if len(routing) > 1 || m.IsRun() {
-				if nested == 0 {
+
+			// A read-only viewer can only resize, grant credit
+			// and hang up, here or in a nested session. Replies
+			// to the program's requests for new windows, from
+			// the server, still reach it.
+			if _, v := from(routing); v != nil && v.readonly {
+				if !m.IsCredit() && !m.IsHangup() && !m.IsTerminalSize() && waits[replied(m)] == nil {
+					continue
+				}
+			}
+
+			// A session shown in a window isn't taken from it.
+			// That window would be left frozen.
+			c, _ := message.As[*message.Share](m)
+			if m.IsAttach() && len(routing) == 1 && len(viewers) > 0 {
+				toTerminal <- [][]byte{routing[0], message.Pty{ID: id}.Bytes(), message.Error{Reason: "session shown in another window"}.Bytes()}
+
+				continue
+			}
+
+			// Every session on the way to the one being attached
+			// that isn't shown anywhere switches to the new
+			// terminal. A detached session being shared is
+			// attached.
+			if (m.IsAttach() || (c != nil && len(routing) == 1)) && len(viewers) == 0 {
+				retarget(routing)
+
+				if len(routing) == 1 {
+					logf(out, "[%s] attached to terminal %s", id, t.ID)
+
+					v := viewers[t.ID]
+					v.readonly = c != nil && c.ReadOnly
+
+					reading = fromProgram
+
+					detached.Remove(id)
+
+					welcome(v)
+
+					continue
+				}
+			} else if c != nil && len(routing) == 1 {
+				v := &Viewer{credit: message.Window, readonly: c.ReadOnly, term: message.Raw(routing[0])}
+
+				if tc, ok := message.As[*message.Term](v.term); ok {
+					logf(out, "[%s] shared with terminal %s", id, tc.ID)
+
+					viewers[tc.ID] = v
+					reading = fromProgram
+
+					welcome(v)
+				}
+
+				continue
+			}
+
+			if m.IsCapture() && len(routing) == 1 {
+				bs := [][]byte{routing[0], message.Pty{ID: id}.Bytes()}
+
+				if vt == nil {
+					bs = append(bs, message.Error{Reason: "no screen for session " + id}.Bytes())
+				} else {
+					bs = append(bs, message.Captured{Text: vt.Text()}.Bytes())
+				}
+
+				toTerminal <- bs
+
+				continue
+			}
+
+			// Every hop forgets the channels of a terminal that
+			// has hung up.
+			if c, ok := message.As[*message.Term](message.Raw(routing[0])); ok && m.IsHangup() {
+				src.Forget(c.ID)
+				up.Forget(routing[0])
+			}
+
+			if len(routing) > 1 || m.IsAttach() || m.IsCapture() || m.IsList() || m.IsRun() || m.IsShare() {
+				if len(nested) == 0 {
 					logf(out, "[%s] error: sending commands to non-mux", id)
 				}
-				toProgram <- append(routing, m.Bytes())
-			} else if ts := m.TerminalSize(); ts != nil {
-				if err := terminal.SetSize(f, ts); err != nil {
-					logf(out, "[%s] error: setting size: %s", id, err.Error())
+				toProgram <- append(down.Route(routing), m.Bytes())
+
+				if m.IsHangup() {
+					down.Forget(routing[0])
+				}
+			} else if m.IsHangup() {
+				// Only a terminal this session is shown on.
+				tid, v := from(routing)
+				if v == nil {
+					continue
+				}
+
+				logf(out, "[%s] terminal %s hung up", id, tid)
+
+				delete(viewers, tid)
+
+				// While there are viewers left, one of them
+				// becomes this session's terminal.
+				if terms := viewers.Terms(); len(terms) > 0 {
+					if tid == t.ID {
+						retarget([][]byte{viewers[terms[0]].term.Bytes()})
+					}
+
+					reading = fromProgram
+
+					resize()
+				} else if detachable {
+					reading = fromProgram
+
+					detached.Add(id, args)
+				} else if len(nested) > 0 {
+					// A nested mux hangs up its own sessions.
+					// Some may be shown on other terminals.
+					for _, route := range nested {
+						toProgram <- append(down.Route(append(routing[:1:1], route...)), m.Bytes())
+						down.Forget(routing[0])
+					}
+				} else if err := terminal.Hangup(cmd.Process); err != nil {
+					logf(out, "[%s] error: hanging up: %s", id, err.Error())
+				}
+			} else if c, ok := message.As[*message.Credit](m); ok {
+				if _, v := from(routing); v != nil {
+					v.credit += c.N
+				}
+
+				if !viewers.Blocked() {
+					reading = fromProgram
 				}
+			} else if c, ok := message.As[*message.TerminalSize](m); ok {
+				if _, v := from(routing); v != nil {
+					v.size = c.Size
+
+					resize()
+				}
+			} else if rid := replied(m); rid != "" {
+				// The reply to the program's request for a new
+				// window. A program that waits for the session
+				// to end also hears when it has.
+				if w := waits[rid]; w != nil {
+					w.to <- [][]byte{m.Bytes()}
+
+					if !w.session || !m.IsAck() {
+						delete(waits, rid)
+
+						if w.to != toProgram {
+							close(w.to)
+						}
+					}
+				}
+			} else if len(nested) == 0 {
+				toProgram <- [][]byte{message.Unquote(m.Bytes())}
 			} else {
+				// A nested mux unquotes text for its own programs.
 				toProgram <- [][]byte{m.Bytes()}
 			}
 
-		case m, ok := <-fromProgram:
-			if !ok || m == nil {
-				goto done
+			continue
+		}
+
+		if !ok || m == nil {
+			goto done
+		}
+
+		// Text from anything other than a nested mux, including
+		// unauthenticated control messages, is quoted so that it
+		// passes through every hop untouched.
+		// This includes everything from a nested mux that does
+		// not speak our protocol.
+		if !k.Verify(m) || refused || (len(nested) == 0 && !m.Is(message.Command)) {
+			if vt != nil && len(nested) == 0 {
+				vt.Write(m.Original())
 			}
 
-			if m.Logging() {
-				toTerminal <- [][]byte{m.Bytes()}
+			m = message.New(message.Text, message.Quote(m.Original()))
+		}
 
-				continue
+		if _, err := m.Decode(); err != nil {
+			logf(out, "[%s] error: %s", id, err.Error())
+
+			continue
+		}
+
+		if m.Logging() {
+			toTerminal <- [][]byte{m.Bytes()}
+
+			continue
+		}
+
+		if src.Buffered(m) {
+			continue
+		}
+
+		// A nested mux says hello before anything else and is
+		// told whether it will be granted credit.
+		if m.IsHello() {
+			if err := message.Compatible(m); err != nil {
+				refused = true
+
+				logf(out, "[%s] error: nested mux: %s", id, err.Error())
+				toTerminal <- append(up.Route(src.Routing()), message.Error{Reason: "nested mux: " + err.Error()}.Bytes())
+			} else {
+				toProgram <- [][]byte{hello().Bytes()}
 			}
 
-			if src.Buffered(m) {
+			continue
+		} else if m.IsBinary() {
+			// Binary framing is never used on a pty.
+			continue
+		}
+
+		routing := src.Routing()
+
+		// A nested session sends its status to each of its viewers.
+		if r := string(bytes.Join(routing[1:], nil)); m.IsStarted() && nested[r] == nil {
+			nested[r] = append([][]byte{}, routing[own:]...)
+			statusq <- &Status{n: 1}
+		} else if m.IsStatus() && nested[r] != nil {
+			delete(nested, r)
+			statusq <- &Status{n: -1}
+		}
+
+		// Output from the program itself, rather than a nested mux
+		// replying to another terminal.
+		mine := len(routing) == own && bytes.Equal(routing[0], term.Bytes())
+
+		// A program that requests a new window hears the reply. It
+		// sends the request's status when it gives up waiting.
+		if c, ok := message.As[*message.Run](m); ok && mine && c.ID != "" {
+			if len(viewers) == 0 {
+				toProgram <- [][]byte{message.Error{Reason: "no window for session " + id, ID: c.ID}.Bytes()}
+
 				continue
 			}
 
-			if m.IsStarted() {
-				nested++
-				statusq <- &Status{n: 1}
-			} else if m.IsStatus() {
-				nested--
-				statusq <- &Status{n: -1}
+			waits[c.ID] = &Waiter{session: c.Wait, to: toProgram}
+		} else if c, ok := message.As[*message.Status](m); ok && mine {
+			delete(waits, c.ID)
+
+			continue
+		}
+
+		// Keep the most recent output from the program itself until
+		// the session is reattached, unless its screen is modeled.
+		// Everything else for this session's terminal is dropped.
+		// Nested sessions may be shown on other terminals.
+		if len(viewers) == 0 && bytes.Equal(routing[0], term.Bytes()) {
+			if mine && m.Is(message.Text) && vt == nil {
+				backlog = append(backlog, m.Bytes()...)
+				if n := len(backlog) - backlogsz; n > 0 {
+					backlog = append([]byte{}, backlog[n:]...)
+				}
+			}
+
+			continue
+		}
+
+		routes := [][][]byte{routing}
+
+		// A request for a new session goes only to this session's
+		// terminal.
+		if mine && !m.IsRun() {
+			// The program's own output goes to every viewer. Each
+			// gets its own batch as a batch has only one address.
+			routes = routes[:0]
+
+			granted := flow.Granted() && m.Is(message.Text)
+
+			for _, tid := range viewers.Terms() {
+				v := viewers[tid]
+				if granted {
+					v.credit--
+				}
+
+				routes = append(routes, append([][]byte{v.term.Bytes()}, routing[1:]...))
 			}
 
-			bs := append(src.Routing(), m.Bytes())
+			// Stop reading from the pty until credit arrives.
+			if granted && viewers.Blocked() {
+				reading = nil
+			}
+		}
+
+		for _, route := range routes {
+			bs := append(up.Route(route), m.Bytes())
 			/*
 				logf(toTerminal, "mux sent {")
 				for _, b := range bs {
@@ -160,16 +1104,6 @@ done:
 	_ = cmd.Wait()
 }
 
-func wd(env []string) string {
-	for _, s := range env {
-		if strings.HasPrefix(s, "PWD=") {
-			return strings.TrimPrefix(s, "PWD=")
-		}
-	}
-
-	return ""
-}
-
 func main() {
 	rv := 0
 	defer func() {
@@ -178,24 +1112,143 @@ func main() {
 		}
 	}()
 
+	attach := ""
 	request := false
+	resume := ""
+	wait := false
 
 	flag.Usage = func() {
 		f := flag.CommandLine.Output()
 		fmt.Fprintf(f, "%s\n\nUsage:\n", os.Args[0])
-		fmt.Fprintf(f, "  %s [-l LABEL] COMMAND ARGUMENTS...\n", os.Args[0])
-		fmt.Fprintf(f, "  %s -n COMMAND ARGUMENTS...\n\n", os.Args[0])
+		fmt.Fprintf(f, "  %s [-l LABEL] [-name NAME] COMMAND ARGUMENTS...\n", os.Args[0])
+		fmt.Fprintf(f, "  %s -n [-w] COMMAND ARGUMENTS...\n", os.Args[0])
+		fmt.Fprintf(f, "  %s -a PATH\n\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 
+	flag.StringVar(&attach, "a", attach, "attach stdin and stdout to the mux resumable at PATH")
 	flag.StringVar(&label, "l", label, "mux label (for debugging)")
+	flag.StringVar(&name, "name", name, "mux name for routing paths (default label or host name)")
 	flag.BoolVar(&request, "n", request, "request new local session")
+	flag.StringVar(&resume, "r", resume, "survive the loss of stdin and stdout and resume at PATH")
+	flag.BoolVar(&wait, "w", wait, "wait for the requested session to end and exit with its status")
 	flag.Parse()
 
+	lexer.Limit = config.MaxMessage(lexer.Limit)
+
+	prefix = config.Route()
+
+	// Without a name, a mux goes by its label or, without one of those,
+	// by the name of its host.
+	if name == "" {
+		name = label
+
+		if h, err := os.Hostname(); err == nil && label == flag.Lookup("l").DefValue {
+			name = h
+		}
+	}
+
+	if attach != "" {
+		if err := relay(attach); err != nil {
+			println(err.Error())
+
+			rv = 1
+		}
+
+		return
+	}
+
 	args, defaulted := config.Command()
 
+	// Without a key everything this mux sends would be quoted, as if
+	// forged, by whatever runs it. Say so rather than silently doing
+	// nothing. A mux used as the entry point on a remote host runs its
+	// command without a mux rather than locking the user out.
+	key := message.ParseKey(config.Key())
+	if key == nil {
+		println("summit-mux: $SUMMIT_KEY is not set. It must be passed to a nested mux,")
+		println("for example, with ssh -o SendEnv=SUMMIT_KEY. See Authentication in the README.")
+
+		rv = 1
+
+		if !request {
+			println("summit-mux: running", strings.Join(args, " "), "without a mux.")
+
+			if err := bypass(args); err != nil {
+				println(err.Error())
+			}
+		}
+
+		return
+	}
+
+	carrier, err := message.ParseCarrier(config.Carrier())
+	if err != nil {
+		println(err.Error())
+
+		rv = 1
+
+		return
+	}
+
+	// Control messages written to a terminal may have to pass through
+	// tmux or screen.
+	stdin := io.Reader(os.Stdin)
+	stdout := io.WriteCloser(os.Stdout)
+	if resume != "" {
+		r, err := resumable(resume)
+		if err != nil {
+			println(err.Error())
+
+			rv = 1
+
+			return
+		}
+
+		stdin, stdout = r, r
+	} else if terminal.IsTTY() {
+		p, _ := message.ParsePassthrough(config.Passthrough())
+		stdout = comms.Wrap(stdout, p)
+	}
+
 	if request {
-		os.Stdout.Write(message.Run(args, os.Environ()))
+		// The key for this hop stays here.
+		env := config.Unsetenv(os.Environ(), "SUMMIT_KEY")
+
+		r := message.Run{Args: args, Env: env, ID: message.NewKey().String(), Wait: wait}
+
+		// Without a terminal to make the request over, it goes over
+		// the control socket of the mux running this session.
+		replies, requests := stdin, stdout
+		tty := terminal.IsTTY() && terminal.IsStdoutTTY()
+
+		if path := config.Control(); path != "" && !tty {
+			c, err := net.Dial("unix", path)
+			if err != nil {
+				println(err.Error())
+
+				rv = 1
+
+				return
+			}
+
+			// The socket is never a terminal.
+			carrier = message.PM
+			replies, requests = c, c
+		}
+
+		requests.Write(carrier.Carry(key.Sign(r.Bytes())))
+
+		rv, err = await(replies, carrier, tty, key, r.ID, wait)
+		if err != nil {
+			println(err.Error())
+
+			// Otherwise a late reply would be written to whatever
+			// reads the terminal next.
+			if replies == stdin {
+				requests.Write(carrier.Carry(key.Sign(message.Status{Status: rv, ID: r.ID}.Bytes())))
+			}
+		}
 
 		return
 	} else if defaulted && terminal.IsTTY() {
@@ -206,28 +1259,56 @@ func main() {
 		return
 	}
 
+	// Programs in this mux's sessions can request new windows over a
+	// socket that only this user can reach.
+	if dir, err := os.MkdirTemp("", "summit-"); err != nil {
+		println(err.Error())
+	} else {
+		defer os.RemoveAll(dir)
+
+		l, err := net.Listen("unix", filepath.Join(dir, "control"))
+		if err != nil {
+			println(err.Error())
+		} else {
+			defer l.Close()
+
+			socket = l.Addr().String()
+
+			go listen(l)
+		}
+	}
+
+	channels := map[string]map[string][]*message.T{} // Pty messages by terminal and channel.
 	done := make(chan struct{})
-	fromServer := comms.Chunk(os.Stdin)
+	fromServer := comms.Pipe(stdin, key, carrier)
 	id := ""
 	nested := 0
 	next := comms.Counter(1)
+	ptys := []*message.T{}
 	routing := []*message.T{}
 	status := (*Status)(nil)
 	statusq := make(chan *Status, 1) // Pty ID + exit status.
 	stream := map[string]chan *message.T{}
-	toServer := comms.Write(os.Stdout, done)
+	term := ""
+	toServer := comms.Write(stdout, key, carrier, done)
 
 	defer func() {
 		if status != nil {
 			rv = status.rv
 
-			toServer <- [][]byte{
-				message.Term(status.term),
-				message.Pty(status.pty),
-				message.Status(rv),
+			for _, t := range status.terms {
+				toServer <- [][]byte{
+					message.Term{ID: t}.Bytes(),
+					message.Pty{ID: status.pty}.Bytes(),
+					message.Status{Status: rv}.Bytes(),
+				}
 			}
 		}
 
+		if s := lexer.Stats(); s != (lexer.Counters{}) {
+			logf(toServer, "lexer recovered from bad messages: %+v", s)
+		}
+
 		close(toServer)
 		<-done
 	}()
@@ -247,10 +1328,13 @@ func main() {
 
 		defer restore()
 
+		// Let the mux running this terminal know what we speak.
+		toServer <- [][]byte{message.NewHello().Bytes()}
+
 		go session(id, c, toServer, statusq)
-		c <- message.Raw(message.Term(""))
-		c <- message.Raw(message.Run(args, os.Environ()))
-		c <- message.Raw(message.TerminalSize(terminal.GetSize()))
+		c <- message.From(message.Term{ID: ""})
+		c <- message.From(message.Run{Args: args, Env: os.Environ()})
+		c <- message.From(message.TerminalSize{Size: terminal.GetSize()})
 	}
 
 	for {
@@ -260,37 +1344,146 @@ func main() {
 				return
 			}
 
+			if !key.Verify(m) {
+				// Text isn't quoted for the 8-bit carriers so,
+				// on a hop that uses one, it may look like a
+				// control message.
+				if !carrier.Is8Bit() {
+					logf(toServer, "error: unauthenticated message from server")
+
+					continue
+				}
+
+				m = message.New(message.Text, m.Original())
+			}
+
 			logf(toServer, "mux recv: %s", m)
 
-			if m.Is(message.Command) {
-				switch {
-				case m.IsPty():
-					if id == "" {
-						id = m.Pty()
-					} else {
-						routing = append(routing, m)
+			c, err := m.Decode()
+			if err != nil {
+				logf(toServer, "error: %s", err.Error())
+
+				continue
+			}
+
+			switch c := c.(type) {
+			case *message.Channel:
+				// A channel ID after pty messages defines it. On
+				// its own it stands in for them.
+				if channels[term] == nil {
+					channels[term] = map[string][]*message.T{}
+				}
+
+				if len(ptys) > 0 {
+					channels[term][c.ID] = ptys
+				} else if ptys = channels[term][c.ID]; len(ptys) > 0 {
+					pty, _ := message.As[*message.Pty](ptys[0])
+
+					id = pty.ID
+					routing = append(routing, ptys[1:]...)
+				}
+
+				continue
+
+			case *message.Attach:
+				if stream[id] == nil {
+					toServer <- [][]byte{
+						message.Term{ID: term}.Bytes(),
+						message.Error{Reason: "no session to attach to"}.Bytes(),
 					}
 
 					continue
+				}
 
-				case m.IsTerm():
-					id = ""
-					routing = []*message.T{m}
+			case *message.Share:
+				if stream[id] == nil {
+					toServer <- [][]byte{
+						message.Term{ID: term}.Bytes(),
+						message.Error{Reason: "no session to share"}.Bytes(),
+					}
 
 					continue
+				}
 
-				case m.IsRun():
-					if id == "" {
-						id = <-next
-						c := make(chan *message.T)
+			case *message.Capture:
+				if stream[id] == nil {
+					toServer <- [][]byte{
+						message.Term{ID: term}.Bytes(),
+						message.Error{Reason: "no session to capture"}.Bytes(),
+					}
 
-						stream[id] = c
+					continue
+				}
+
+			case *message.Hello:
+				if err := message.Compatible(m); err != nil {
+					logf(toServer, "error: %s", err.Error())
+				}
+
+				// Credit is only waited for if it will be granted.
+				flow.Set(c.Supports("credit"))
+
+				// A mux on a terminal has already said hello.
+				// This is the reply.
+				if terminal.IsTTY() {
+					continue
+				}
+
+				toServer <- [][]byte{message.NewHello().Bytes()}
 
-						go session(id, c, toServer, statusq)
+				// Binary framing is only used when not on a terminal.
+				if c.Supports("binary") {
+					toServer <- [][]byte{message.Binary{}.Bytes()}
+				}
+
+				continue
+
+			case *message.List:
+				if id == "" {
+					toServer <- [][]byte{
+						message.Term{ID: term}.Bytes(),
+						message.Sessions{Detached: detached.List()}.Bytes(),
 					}
+
+					continue
+				}
+
+			case *message.Pty:
+				ptys = append(ptys, m)
+
+				if id == "" {
+					id = c.ID
+				} else {
+					routing = append(routing, m)
+				}
+
+				continue
+
+			case *message.Term:
+				id = ""
+				ptys = nil
+				routing = []*message.T{m}
+				term = c.ID
+
+				continue
+
+			case *message.Run:
+				if id == "" {
+					id = <-next
+					in := make(chan *message.T)
+
+					stream[id] = in
+
+					go session(id, in, toServer, statusq)
 				}
 			}
 
+			// The sender forgets a terminal's channels when it
+			// hangs up and so do we.
+			if m.IsHangup() {
+				delete(channels, term)
+			}
+
 			selected := stream[id]
 			if selected == nil {
 				continue
@@ -315,10 +1508,12 @@ func main() {
 			if s.pty == "0" {
 				status = s
 			} else {
-				toServer <- [][]byte{
-					message.Term(s.term),
-					message.Pty(s.pty),
-					message.Status(s.rv),
+				for _, t := range s.terms {
+					toServer <- [][]byte{
+						message.Term{ID: t}.Bytes(),
+						message.Pty{ID: s.pty}.Bytes(),
+						message.Status{Status: s.rv}.Bytes(),
+					}
 				}
 			}
 
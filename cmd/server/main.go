@@ -3,24 +3,77 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/michaelmacinnis/summit/pkg/buffer"
+	"github.com/michaelmacinnis/summit/pkg/cast"
 	"github.com/michaelmacinnis/summit/pkg/comms"
 	"github.com/michaelmacinnis/summit/pkg/config"
+	"github.com/michaelmacinnis/summit/pkg/lexer"
 	"github.com/michaelmacinnis/summit/pkg/message"
 )
 
+// Errors returned when resolving names.
 var (
-	client = config.Get("SUMMIT_CLIENT", "summit-client")
-	mux    = config.Get("SUMMIT_MUX", "summit-mux")
-	term   = config.Get("SUMMIT_TERMINAL", "./xfce-terminal")
+	errAmbiguousName = errors.New("ambiguous name")
+	errUnknownName   = errors.New("no mux with name")
+)
+
+// Attempts to reattach to a mux before giving up on it.
+const attempts = 10
+
+// Time to wait for the mux to say hello before refusing clients.
+const hellowait = 30 * time.Second
+
+// Exit status, as if hung up, reported for a session whose window went
+// away before it ended.
+const hangup = 129
+
+// Names holds the name of each nested mux, by the routing path of the
+// session it runs in.
+type Names struct {
+	sync.Mutex
+
+	muxes map[string]string
+}
+
+// Requester is where to send replies to a program that requested a new
+// window.
+type Requester struct {
+	route [][]byte
+	toMux chan [][]byte
+}
+
+// Waiting holds, by ID, the requesters waiting for a new window's
+// session to start and, if asked, to end.
+type Waiting struct {
+	sync.Mutex
+
+	requesters map[string]*Requester
+}
+
+var (
+	client  = config.Get("SUMMIT_CLIENT", "summit-client")
+	mux     = config.Get("SUMMIT_MUX", "summit-mux")
+	names   = &Names{muxes: map[string]string{}}
+	record  = config.Get("SUMMIT_RECORD", "")
+	resume  = config.Get("SUMMIT_RESUME", "")
+	term    = config.Get("SUMMIT_TERMINAL", "./xfce-terminal")
+	waiting = &Waiting{requesters: map[string]*Requester{}}
 )
 
 func address(offset int, bs [][]byte) (string, string) {
@@ -29,14 +82,15 @@ func address(offset int, bs [][]byte) (string, string) {
 
 	term := ""
 	for _, b := range bs {
-		m := message.Raw(b)
-		switch {
-		case m.IsPty():
-			path[n] = m.Pty()
+		c, _ := message.Raw(b).Decode()
+
+		switch c := c.(type) {
+		case *message.Pty:
+			path[n] = c.ID
 			n++
 
-		case m.IsTerm():
-			term = m.Term()
+		case *message.Term:
+			term = c.ID
 		}
 	}
 
@@ -48,73 +102,175 @@ func address(offset int, bs [][]byte) (string, string) {
 	return term, ""
 }
 
-func dispatch(accepted <-chan net.Conn, fromMux chan *message.T, toMux chan [][]byte) {
+func dispatch(accepted <-chan net.Conn, k message.Key, fromMux chan *message.T, toMux chan [][]byte) {
 	next := comms.Counter(1)
 
 	terminals := map[string]chan *message.T{}
 
+	// Terminals send their ID here when their client goes away.
+	hungup := make(chan string)
+
+	// Closed, as is the channel to every terminal, once the mux is gone.
+	done := make(chan struct{})
+
+	defer func() {
+		close(done)
+
+		for _, c := range terminals {
+			close(c)
+		}
+	}()
+
 	var current chan *message.T
 	var id string
 
+	// Set if the mux does not speak our protocol.
+	var refused error
+
+	// Clients wait until the mux has said hello or has taken too long
+	// to. A mux that never says hello is too old to speak our protocol.
+	incoming := (<-chan net.Conn)(nil)
+	timeout := time.After(hellowait)
+
 	for {
 		select {
-		case conn := <-accepted:
+		case <-timeout:
+			refused = fmt.Errorf("%w: none from mux after %v", message.ErrHello, hellowait)
+			println("mux:", refused.Error())
+
+			incoming = accepted
+			timeout = nil
+
+		case conn := <-incoming:
 			println("New terminal.")
 
 			id = <-next
 
+			// Delivering to a terminal never blocks the others.
+			// Credit bounds what is queued for a terminal that is
+			// slow to read to a window of text messages for each
+			// session shown on it, each no more than a read, and
+			// the control messages between them.
 			fromDispatch := make(chan *message.T)
 			terminals[id] = fromDispatch
 
-			go terminal(id, conn, fromDispatch, toMux)
+			go terminal(id, conn, refused, comms.Queue(fromDispatch), toMux, hungup, done)
+
+		case t := <-hungup:
+			if current == terminals[t] {
+				current = nil
+			}
+
+			close(terminals[t])
+			delete(terminals, t)
 
 		case m, ok := <-fromMux:
 			if !ok {
 				return
 			}
 
-			if m.Is(message.Command) {
-				if m.Logging() {
-					println("LOGGING:", m.Log())
-					continue
+			if !k.Verify(m) {
+				println("dropping unauthenticated message from mux.")
+
+				continue
+			}
+
+			c, err := m.Decode()
+			if err != nil {
+				println("dropping message from mux:", err.Error())
+
+				continue
+			}
+
+			switch c := c.(type) {
+			case *message.Log:
+				println("LOGGING:", c.Text)
+
+				continue
+
+			case *message.Hello:
+				incoming = accepted
+				timeout = nil
+
+				refused = message.Compatible(m)
+				if refused != nil {
+					println("mux:", refused.Error())
+				} else if c.Supports("binary") {
+					// Our pipe to the mux is never a terminal.
+					toMux <- [][]byte{message.Binary{}.Bytes()}
 				}
 
-				if n := m.Term(); n != "" {
-					id = n
+				continue
+
+			case *message.Term:
+				if c.ID != "" {
+					id = c.ID
 					current = terminals[id]
 
 					continue
 				}
 			}
 
-			if current != nil {
-				current <- m
+			// Messages in binary framing are addressed to their
+			// terminal. Anything else goes to the terminal named
+			// by the last term message.
+			dst := current
+			if a := m.Address(); a != "" {
+				dst = terminals[a]
+				if dst == nil {
+					println("dropping message for unknown terminal:", a)
+
+					continue
+				}
+			}
+
+			if dst != nil {
+				dst <- m
 			}
 		}
 	}
 }
 
-func launch(path string) (*exec.Cmd, chan *message.T, chan [][]byte) {
-	cmd := exec.Command(path, "-l", "main")
-
-	in, err := cmd.StdinPipe()
-	if err != nil {
-		panic(err.Error())
+func launch(path string, k message.Key) (func(), chan *message.T, chan [][]byte) {
+	args := []string{"-l", "main"}
+	if resume != "" {
+		args = append(args, "-r", resume)
 	}
 
-	out, err := cmd.StdoutPipe()
+	cmd, t, err := start(path, k, args...)
 	if err != nil {
 		panic(err.Error())
 	}
 
-	cmd.Stderr = os.Stderr
+	wait := func() { _ = cmd.Wait() }
 
-	err = cmd.Start()
-	if err != nil {
-		panic(err.Error())
+	if resume != "" {
+		done := make(chan struct{})
+		r := comms.NewReliable()
+
+		go reattach(r, path, k, cmd, t, done)
+
+		t = r
+		wait = func() { <-done }
 	}
 
-	return cmd, comms.Chunk(out), comms.Write(in)
+	toMux := comms.Write(t, k, message.PM)
+
+	toMux <- [][]byte{message.NewHello().Bytes()}
+
+	// The mux frames what it writes with the carrier it inherits.
+	c, _ := message.ParseCarrier(config.Carrier())
+
+	return wait, comms.Pipe(t, k, c), toMux
+}
+
+// learn records the name of the mux that started a session.
+func learn(m *message.T, routing [][]byte) {
+	if c, ok := message.As[*message.Started](m); ok && c.Name != "" {
+		if _, path := address(-1, routing); path != "" {
+			names.Add(path, c.Name)
+		}
+	}
 }
 
 func listen(accepted chan net.Conn) {
@@ -139,123 +295,591 @@ func listen(accepted chan net.Conn) {
 	}
 }
 
-func terminal(id string, conn net.Conn, fromMux <-chan *message.T, toMux chan [][]byte) {
+// Carry the hop to the mux over t and, when t fails, over the pipes to a
+// new "mux -a" until the mux can't be reached.
+func reattach(r *comms.Reliable, path string, k message.Key, cmd *exec.Cmd, t io.ReadWriteCloser, done chan struct{}) {
+	defer close(done)
+
+	for failures := 0; failures < attempts; {
+		if t == nil {
+			time.Sleep(time.Second)
+
+			var err error
+
+			cmd, t, err = start(path, k, "-a", resume)
+			if err != nil {
+				println("reattaching to mux:", err.Error())
+
+				failures++
+
+				continue
+			}
+		}
+
+		err := r.Attach(t)
+
+		t.Close()
+		_ = cmd.Wait()
+
+		t = nil
+
+		if err == nil {
+			return
+		}
+
+		println("mux hop failed:", err.Error())
+
+		if errors.Is(err, comms.ErrHandshake) {
+			failures++
+		} else {
+			failures = 0
+		}
+	}
+
+	println("giving up on mux.")
+
+	r.Close()
+}
+
+// recording starts recording the session at path, shown on the terminal
+// with the given ID, in the record directory.
+func recording(path, id string, ts *message.TerminalSize) *cast.T {
+	width, height := 80, 24
+	if ts != nil {
+		width, height = int(ts.Size.Cols), int(ts.Size.Rows)
+	}
+
+	name := fmt.Sprintf("%s.%s.%s.cast", path, time.Now().Format("20060102-150405"), id)
+
+	rec, err := cast.Create(filepath.Join(record, name), width, height, "")
+	if err != nil {
+		println("recording:", err.Error())
+
+		return nil
+	}
+
+	return rec
+}
+
+func refuse(toClient chan [][]byte, written chan struct{}, err error) {
+	println("refusing client:", err.Error())
+
+	toClient <- [][]byte{message.Error{Reason: err.Error()}.Bytes()}
+
+	close(toClient)
+	<-written
+}
+
+func start(path string, k message.Key, args ...string) (*exec.Cmd, io.ReadWriteCloser, error) {
+	cmd := exec.Command(path, args...)
+
+	cmd.Env = config.Setenv(os.Environ(), "SUMMIT_KEY", k.String())
+
+	// The mux's sessions are at the top, even if the server isn't.
+	cmd.Env = config.Setenv(cmd.Env, "SUMMIT_ROUTE", "")
+
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cmd.Stderr = os.Stderr
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return cmd, comms.Join(out, in), nil
+}
+
+func terminal(id string, conn net.Conn, refused error, fromMux <-chan *message.T, toMux chan [][]byte, hungup chan<- string, done <-chan struct{}) {
 	defer conn.Close()
 
-	fromClient := comms.Chunk(conn)
-	toClient := comms.Write(conn)
+	defer func() {
+		// Messages for this terminal are discarded until the
+		// dispatcher has deleted its entry.
+		go func() {
+			for range fromMux {
+			}
+		}()
+
+		// A dispatcher whose mux is gone isn't listening.
+		select {
+		case hungup <- id:
+		case <-done:
+		}
+	}()
+
+	// Each client connection is a separate hop with its own key.
+	k := message.NewKey()
+
+	fromClient := comms.Chunk(conn, message.PM)
+	written := make(chan struct{})
+	toClient := comms.Write(conn, k, message.PM, written)
 
-	term := message.Raw(message.Term(id))
+	toClient <- [][]byte{message.Secret{Key: k}.Bytes(), message.NewHello().Bytes()}
+
+	// A client that disconnects before saying anything is gone.
+	m := verified(fromClient, k)
+	if m == nil {
+		close(toClient)
+		<-written
+
+		return
+	} else if err := message.Compatible(m); err != nil {
+		refuse(toClient, written, err)
+
+		return
+	} else if refused != nil {
+		refuse(toClient, written, refused)
+
+		return
+	}
+
+	term := message.From(message.Term{ID: id})
 
 	println("getting request from client")
 
 	dst := buffer.New(term)
 
-	m := <-fromClient
+	// Routes sent to the mux and to the client.
+	down := buffer.NewChannels()
+	up := buffer.NewChannels()
+
+	m = verified(fromClient, k)
 	for dst.Buffered(m) {
-		m = <-fromClient
+		m = verified(fromClient, k)
+	}
+
+	// Nothing has been sent to the mux for a client that disconnects
+	// before making its request, so there is nothing to hang up.
+	if m == nil {
+		close(toClient)
+		<-written
+
+		return
+	}
+
+	// Names are resolved here rather than by a mux.
+	if c, ok := message.As[*message.Resolve](m); ok {
+		path, err := names.Resolve(c.Name)
+		if err != nil {
+			toClient <- [][]byte{message.Error{Reason: err.Error()}.Bytes()}
+		} else {
+			toClient <- [][]byte{message.Resolved{Path: path}.Bytes()}
+		}
+
+		close(toClient)
+		<-written
+
+		return
+	}
+
+	// A window opened for a requester reports whether its session
+	// started and, if the requester is waiting, when it ends.
+	wait := ""
+	waited := false
+	requester := (*Requester)(nil)
+
+	if r, ok := message.As[*message.Run](m); ok && r.ID != "" {
+		wait = r.ID
+		waited = r.Wait
+		requester = waiting.Take(wait)
 	}
 
 	println("sending request to mux")
 
-	toMux <- append(dst.Routing(), m.Bytes())
+	toMux <- append(down.Route(dst.Routing()), m.Bytes())
 
 	println("getting response from mux")
 
 	src := buffer.New()
 
+	// Messages delivered but not yet credited, by source route.
+	delivered := map[string]int{}
+
+	// Recordings, by path, of the sessions shown on this terminal.
+	recordings := map[string]*cast.T{}
+	size := (*message.TerminalSize)(nil)
+
+	defer func() {
+		for _, rec := range recordings {
+			if rec != nil {
+				rec.Close()
+			}
+		}
+	}()
+
 	m = <-fromMux
 	for src.Buffered(m) {
 		m = <-fromMux
 	}
 
+	// Only a session started or attached by this terminal is hung up
+	// when it goes away.
+	attached := m.IsStarted() || m.IsAttached()
+
+	_, session := address(0, src.Routing())
+
+	learn(m, src.Routing())
+
+	// The requester hears why the window's session didn't start or,
+	// if it did, that the request succeeded.
+	if e, ok := message.As[*message.Error](m); ok && requester != nil {
+		requester.Send(message.Error{Reason: e.Reason, ID: wait})
+
+		requester = nil
+	} else if requester != nil {
+		requester.Send(message.Ack{ID: wait})
+
+		if !waited {
+			requester = nil
+		}
+	}
+
 	println("sending response to client")
 
-	toClient <- append(src.Routing(), m.Bytes())
+	toClient <- append(up.Route(src.Routing()), m.Bytes())
 
 	for {
-		select {
-		case m, ok := <-fromClient:
+		// Input from the client goes ahead of output from the mux.
+		m, ok, input := comms.Prefer(fromClient, fromMux)
+
+		if input {
 			if !ok || m == nil {
 				println("client channel closed or nil message.")
 				goto done
 			}
 
+			if !k.Verify(m) {
+				println("dropping unauthenticated message from client.")
+
+				continue
+			}
+
+			if _, err := m.Decode(); err != nil {
+				println("dropping message from client:", err.Error())
+
+				continue
+			}
+
 			if dst.Buffered(m) {
 				continue
 			}
 
-			toMux <- append(dst.Routing(), m.Bytes())
+			if c, ok := message.As[*message.TerminalSize](m); ok && (size == nil || *c.Size != *size.Size) {
+				size = c
+
+				for _, rec := range recordings {
+					if rec != nil {
+						rec.Resize(int(c.Size.Cols), int(c.Size.Rows))
+					}
+				}
+			}
+
+			toMux <- append(down.Route(dst.Routing()), m.Bytes())
+
+			continue
+		}
 
 		// From mux (after being demultiplexed by the dispatcher).
-		case m, ok := <-fromMux:
-			if !ok || m == nil {
-				println("mux channel closed or nil message.")
-				goto done
+		if !ok || m == nil {
+			println("mux channel closed or nil message.")
+			goto done
+		}
+
+		if src.Buffered(m) {
+			continue
+		}
+
+		// Already decoded by the dispatcher.
+		c, _ := m.Decode()
+
+		routing := src.Routing()
+
+		learn(m, routing)
+
+		// A mux is gone when the session it runs in ends.
+		if _, path := address(0, routing); m.IsStatus() && path != "" {
+			names.Remove(path)
+		}
+
+		// Tell a requester waiting for this session that it has ended.
+		if s, ok := c.(*message.Status); ok && requester != nil {
+			if _, path := address(0, routing); path == session {
+				requester.Send(message.Status{Status: s.Status, ID: wait})
+				requester = nil
 			}
+		}
 
-			if src.Buffered(m) {
-				continue
+		if r, ok := c.(*message.Run); ok {
+			go window(r, append([][]byte{term.Bytes()}, routing...), toMux)
+		} else {
+			toClient <- append(up.Route(routing), m.Bytes())
+		}
+
+		// Record what the client writes to its terminal.
+		if _, path := address(0, routing); record != "" && path != "" {
+			rec, ok := recordings[path]
+			if !ok {
+				rec = recording(path, id, size)
+				recordings[path] = rec
 			}
 
-			if m.IsRun() {
-				go window(m, src.Routing())
-			} else {
-				toClient <- append(src.Routing(), m.Bytes())
+			if rec != nil && m.Is(message.Text) {
+				rec.Output(message.Unquote(m.Bytes()))
+			} else if rec != nil && m.IsStatus() {
+				rec.Close()
+				recordings[path] = nil
 			}
 		}
+
+		// Credit the session that produced the text. Its mux
+		// debits all of the text it sends and nothing else.
+		if !m.Is(message.Text) {
+			continue
+		}
+
+		from := string(bytes.Join(routing, nil))
+		if delivered[from]++; delivered[from] >= message.Window/2 {
+			route := append([][]byte{term.Bytes()}, routing...)
+			toMux <- append(down.Route(route), message.Credit{N: delivered[from]}.Bytes())
+
+			delete(delivered, from)
+		}
 	}
 
 done:
-	// TODO: Write control message to delete terminal entry.
-	return
+	// Hang up the session so that it doesn't outlive its terminal.
+	if attached {
+		toMux <- append(down.Route(dst.Routing()), message.Hangup{}.Bytes())
+
+		// Its status won't be seen here, so forget any muxes in it
+		// now.
+		if session != "" {
+			names.Remove(session)
+		}
+	}
+
+	if requester != nil {
+		requester.Send(message.Status{Status: hangup, ID: wait})
+	}
+
+	// What the mux sent before it went away, like the session's
+	// status, reaches the client before its connection is closed.
+	close(toClient)
+	<-written
 }
 
-func window(m *message.T, routing [][]byte) {
+func verified(c <-chan *message.T, k message.Key) *message.T {
+	for m := range c {
+		if k.Verify(m) {
+			return m
+		}
+
+		println("dropping unauthenticated message from client.")
+	}
+
+	return nil
+}
+
+func window(r *message.Run, route [][]byte, toMux chan [][]byte) {
 	args := []string{client}
 
+	// The window's client says which request it is for and, when it
+	// has started the session, the requester is acknowledged.
+	req := &Requester{route: route, toMux: toMux}
+	if r.ID != "" {
+		waiting.Add(r.ID, req)
+		args = append(args, "-id", r.ID)
+
+		if r.Wait {
+			args = append(args, "-w")
+		}
+	}
+
+	routing := route[1:]
+
 	_, path := address(-1, routing)
 	if path != "" {
 		args = append(args, "-p", path)
 	}
 
-	j, err := json.Marshal(m.Env())
+	j, err := json.Marshal(r.Env)
 	if err != nil {
 		println(err.Error())
 	} else {
 		args = append(args, "-e", string(j))
 	}
 
-	args = append(args, m.Args()...)
+	args = append(args, r.Args...)
 
 	println("REQUEST:", fmt.Sprintf("%s %v", term, args))
 
 	cmd := exec.Command(term, args...)
 
+	// The launcher knows where the request came from.
+	_, from := address(0, routing)
+
+	cmd.Env = config.Setenv(os.Environ(), "SUMMIT_DEPTH", strconv.Itoa(strings.Count(from, "-")+1))
+	cmd.Env = config.Setenv(cmd.Env, "SUMMIT_LABEL", config.Getenv(r.Env, "SUMMIT_LABEL", ""))
+	cmd.Env = config.Setenv(cmd.Env, "SUMMIT_PTY", from[strings.LastIndex(from, "-")+1:])
+	cmd.Env = config.Setenv(cmd.Env, "SUMMIT_ROUTE", from)
 	cmd.Stderr = os.Stderr
 
-	err = cmd.Run()
-	if err != nil {
+	if err = cmd.Start(); err != nil {
 		println(err.Error())
+
+		waiting.Take(r.ID)
+
+		if r.ID != "" {
+			req.Send(message.Error{Reason: "opening window: " + err.Error(), ID: r.ID})
+		}
+
+		return
+	}
+
+	if err = cmd.Wait(); err != nil {
+		println(err.Error())
+
+		// No client will report on the session.
+		if waiting.Take(r.ID) != nil {
+			req.Send(message.Error{Reason: "opening window: " + err.Error(), ID: r.ID})
+		}
+	}
+}
+
+// Add records that the mux in the session at path is called name.
+func (ns *Names) Add(path, name string) {
+	ns.Lock()
+	defer ns.Unlock()
+
+	ns.muxes[path] = name
+}
+
+// Remove forgets the muxes in the session at path and in the sessions
+// below it. An empty path forgets every mux.
+func (ns *Names) Remove(path string) {
+	ns.Lock()
+	defer ns.Unlock()
+
+	for p := range ns.muxes {
+		if path == "" || p == path || strings.HasPrefix(p, path+"-") {
+			delete(ns.muxes, p)
+		}
 	}
 }
 
+// Resolve returns the routing path of the mux called name. Nested muxes
+// are named, like files, by the names of the muxes they are in and then
+// their own, separated by slashes. A session in a named mux is named by
+// the mux's name, a slash, and the session's ID.
+func (ns *Names) Resolve(name string) (string, error) {
+	ns.Lock()
+	defer ns.Unlock()
+
+	paths := ns.find(name)
+
+	i := strings.LastIndex(name, "/")
+	if id := name[i+1:]; len(paths) == 0 && i > 0 && id != "" && strings.Trim(id, "0123456789") == "" {
+		for _, path := range ns.find(name[:i]) {
+			paths = append(paths, path+"-"+id)
+		}
+	}
+
+	switch len(paths) {
+	case 0:
+		return "", fmt.Errorf("%w: %s", errUnknownName, name)
+	case 1:
+		return paths[0], nil
+	}
+
+	sort.Strings(paths)
+
+	return "", fmt.Errorf("%w: %s could be %s", errAmbiguousName, name, strings.Join(paths, " or "))
+}
+
+// find returns the routing paths of the muxes called name.
+func (ns *Names) find(name string) []string {
+	paths := []string{}
+
+	for path := range ns.muxes {
+		parts := strings.Split(path, "-")
+		full := make([]string, len(parts))
+
+		for i := range parts {
+			full[i] = ns.muxes[strings.Join(parts[:i+1], "-")]
+		}
+
+		if strings.Join(full, "/") == name {
+			paths = append(paths, path)
+		}
+	}
+
+	return paths
+}
+
+// Add registers a requester waiting for the session requested as id.
+func (w *Waiting) Add(id string, r *Requester) {
+	w.Lock()
+	defer w.Unlock()
+
+	w.requesters[id] = r
+}
+
+// Take removes and returns the requester waiting for the session
+// requested as id, if there is one.
+func (w *Waiting) Take(id string) *Requester {
+	w.Lock()
+	defer w.Unlock()
+
+	r := w.requesters[id]
+	delete(w.requesters, id)
+
+	return r
+}
+
+// Send sends c down the route to r.
+func (r *Requester) Send(c message.Control) {
+	route := append([][]byte{}, r.route...)
+
+	r.toMux <- append(route, c.Bytes())
+}
+
 func main() {
 	flag.StringVar(&client, "c", client, "path to summit client")
 	flag.StringVar(&mux, "m", mux, "path to summit mux")
+	flag.StringVar(&record, "record", record, "directory for recordings of each session (asciicast files)")
+	flag.StringVar(&resume, "r", resume, "socket path for resuming the hop to the mux")
 	flag.StringVar(&term, "t", term, "path to terminal emulator")
 	config.Parse()
 
+	lexer.Limit = config.MaxMessage(lexer.Limit)
+
 	accepted := make(chan net.Conn)
 
 	// Listen for connections and send them to accepted.
 	go listen(accepted)
 
 	for {
-		cmd, fromMux, toMux := launch(mux)
+		k := message.NewKey()
 
-		go dispatch(accepted, fromMux, toMux)
+		wait, fromMux, toMux := launch(mux, k)
 
-		cmd.Wait()
+		go dispatch(accepted, k, fromMux, toMux)
+
+		wait()
+
+		names.Remove("")
+
+		if s := lexer.Stats(); s != (lexer.Counters{}) {
+			println(fmt.Sprintf("lexer recovered from bad messages: %+v", s))
+		}
 	}
 }
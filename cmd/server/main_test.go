@@ -0,0 +1,199 @@
+// Released under an MIT license. See LICENSE.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/michaelmacinnis/summit/pkg/comms"
+	"github.com/michaelmacinnis/summit/pkg/message"
+)
+
+func TestNames(t *testing.T) {
+	ns := &Names{muxes: map[string]string{}}
+
+	// The mux in session 1 is called a. It runs muxes called b and c in
+	// its sessions 2 and 3, and the mux in session 3 runs another b. The
+	// muxes in sessions 4 and 5 are both called d.
+	ns.Add("1", "a")
+	ns.Add("1-2", "b")
+	ns.Add("1-3", "c")
+	ns.Add("1-3-6", "b")
+	ns.Add("4", "d")
+	ns.Add("5", "d")
+
+	tests := []struct {
+		name string
+		path string
+		err  error
+	}{
+		{"a", "1", nil},
+		{"a/b", "1-2", nil},
+		{"a/c/b", "1-3-6", nil},
+		{"a/7", "1-7", nil},
+		{"a/c/8", "1-3-8", nil},
+		{"b", "", errUnknownName},
+		{"a/x", "", errUnknownName},
+		{"a/", "", errUnknownName},
+		{"/2", "", errUnknownName},
+		{"d", "", errAmbiguousName},
+		{"d/9", "", errAmbiguousName},
+	}
+
+	for _, test := range tests {
+		path, err := ns.Resolve(test.name)
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got error %v, want %v", test.name, err, test.err)
+		} else if path != test.path {
+			t.Errorf("%s: got %q, want %q", test.name, path, test.path)
+		}
+	}
+
+	// An ambiguous name lists every path it could be.
+	if _, err := ns.Resolve("d/9"); err == nil || !strings.HasSuffix(err.Error(), "d/9 could be 4-9 or 5-9") {
+		t.Errorf("got %v, want both paths listed", err)
+	}
+
+	// Removing a session forgets the muxes in and below it, and only
+	// those.
+	ns.Remove("1-3")
+
+	for _, name := range []string{"a/c", "a/c/b"} {
+		if _, err := ns.Resolve(name); !errors.Is(err, errUnknownName) {
+			t.Errorf("%s: got %v after removal, want %v", name, err, errUnknownName)
+		}
+	}
+
+	if path, err := ns.Resolve("a/b"); err != nil || path != "1-2" {
+		t.Errorf("a/b: got %q, %v after removal of a sibling", path, err)
+	}
+
+	// Session 1 isn't a prefix of session 10.
+	ns.Add("10", "e")
+	ns.Remove("1")
+
+	if path, err := ns.Resolve("e"); err != nil || path != "10" {
+		t.Errorf("e: got %q, %v after removal of 1", path, err)
+	}
+
+	ns.Remove("")
+
+	if len(ns.muxes) != 0 {
+		t.Errorf("got %v after removing everything", ns.muxes)
+	}
+}
+
+// Keystrokes reach the mux from a terminal whose session floods it with
+// output faster than the client can read, within a bound. Taken in
+// order, the output queued ahead of the last keystroke would take
+// seconds.
+func TestTerminalLatency(t *testing.T) {
+	const (
+		flood = 20000
+		keys  = 20
+		limit = 50 * time.Millisecond
+		read  = 200 * time.Microsecond // By the slow client.
+	)
+
+	client, conn := net.Pipe()
+	defer client.Close()
+
+	fromDispatch := make(chan *message.T)
+	defer close(fromDispatch)
+
+	toMux := make(chan [][]byte)
+	hungup := make(chan string, 1)
+	done := make(chan struct{})
+
+	defer close(done)
+
+	go terminal("7", conn, nil, comms.Queue(fromDispatch), toMux, hungup, done)
+
+	// The mux starts the session and floods it with output. It notes
+	// when each keystroke arrives.
+	arrived := make(chan time.Time, keys)
+
+	go func() {
+		for bs := range toMux {
+			m := message.Raw(bs[len(bs)-1])
+			if !m.Is(message.Command) {
+				arrived <- time.Now()
+			} else if m.IsRun() {
+				go func() {
+					pty := message.From(message.Pty{ID: "1"})
+
+					fromDispatch <- pty
+					fromDispatch <- message.From(message.Started{})
+
+					line := bytes.Repeat([]byte("flood "), 10)
+					for i := 0; i < flood; i++ {
+						fromDispatch <- pty
+						fromDispatch <- message.New(message.Text, line)
+					}
+				}()
+			}
+		}
+	}()
+
+	fromServer := comms.Chunk(client, message.PM)
+
+	secret, ok := message.As[*message.Secret](<-fromServer)
+	if !ok {
+		t.Fatal("expected secret message")
+	}
+
+	if err := message.Compatible(<-fromServer); err != nil {
+		t.Fatal(err)
+	}
+
+	toServer := comms.Write(client, secret.Key, message.PM)
+	toServer <- [][]byte{message.NewHello().Bytes(), message.Run{Args: []string{"sh"}}.Bytes()}
+
+	// Wait for the session to start and output to queue up.
+	for m := range fromServer {
+		if m.IsStarted() {
+			break
+		}
+	}
+
+	time.Sleep(50 * time.Millisecond)
+
+	go func() {
+		for range fromServer {
+			time.Sleep(read)
+		}
+	}()
+
+	sent := make([]time.Time, 0, keys)
+
+	for i := 0; i < keys; i++ {
+		sent = append(sent, time.Now())
+		toServer <- [][]byte{{'a' + byte(i)}}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	worst := time.Duration(0)
+
+	for i := 0; i < keys; i++ {
+		select {
+		case at := <-arrived:
+			if d := at.Sub(sent[i]); d > worst {
+				worst = d
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("keystroke %d never reached the mux", i)
+		}
+	}
+
+	t.Logf("worst input latency %v", worst)
+
+	if worst > limit {
+		t.Errorf("input took %v to reach the mux under a flood of output, want at most %v", worst, limit)
+	}
+}
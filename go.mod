@@ -3,7 +3,7 @@ module github.com/michaelmacinnis/summit
 go 1.18
 
 require (
-	github.com/creack/pty v1.1.17 // indirect
-	golang.org/x/sys v0.0.0-20220608164250-635b8c9b7f68 // indirect
-	golang.org/x/term v0.0.0-20210927222741-03fcf44c2211 // indirect
+	github.com/creack/pty v1.1.17
+	golang.org/x/sys v0.0.0-20220608164250-635b8c9b7f68
+	golang.org/x/term v0.0.0-20210927222741-03fcf44c2211
 )
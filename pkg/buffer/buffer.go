@@ -19,15 +19,23 @@ type T struct {
 
 	buffer  [][]byte
 	routing [][]byte
+
+	// Routes received by channel ID, by terminal ID.
+	channels map[string]map[string][][]byte
+	term     string
+
+	// Set when a channel ID stands in for a route never seen.
+	lost bool
 }
 
 type buffer = T
 
 func New(prefix ...*message.T) *buffer {
 	return &buffer{
-		buffer:  bytes(prefix),
-		prefix:  prefix,
-		routing: bytes(prefix),
+		buffer:   bytes(prefix),
+		prefix:   prefix,
+		routing:  bytes(prefix),
+		channels: map[string]map[string][][]byte{},
 	}
 }
 
@@ -43,12 +51,37 @@ func (b *buffer) Buffered(m *message.T) bool {
 		if !b.buffering {
 			b.buffering = true
 			b.completed = false
+			b.lost = false
+			b.term = ""
 		}
 
-		if m.IsPty() {
+		c, _ := m.Decode()
+
+		switch c := c.(type) {
+		case *message.Channel:
+			channels := b.channels[b.term]
+			if channels == nil {
+				channels = map[string][][]byte{}
+				b.channels[b.term] = channels
+			}
+
+			// A channel ID after a route defines it. On its own
+			// it stands in for the route.
+			if n := len(b.prefix); len(b.buffer) > n {
+				channels[c.ID] = append([][]byte{}, b.buffer[n:]...)
+			} else if route, ok := channels[c.ID]; ok {
+				b.buffer = append(b.buffer, route...)
+			} else {
+				b.lost = true
+			}
+
+		case *message.Pty:
 			b.buffer = append(b.buffer, m.Bytes())
-		} else if m.IsTerm() {
-			if m.Term() != "" {
+
+		case *message.Term:
+			b.term = c.ID
+
+			if c.ID != "" {
 				if len(b.prefix) > 0 && b.prefix[0].IsTerm() {
 					b.buffer[0] = m.Bytes()
 				}
@@ -58,6 +91,16 @@ func (b *buffer) Buffered(m *message.T) bool {
 		return true
 	}
 
+	// A message for a route that was forgotten, or never defined, is
+	// dropped rather than taken as one for the prefix.
+	if b.lost {
+		b.buffer = bytes(b.prefix)
+		b.buffering = false
+		b.lost = false
+
+		return true
+	}
+
 	if !b.completed {
 		b.routing = b.buffer
 		b.buffer = bytes(b.prefix)
@@ -69,6 +112,30 @@ func (b *buffer) Buffered(m *message.T) bool {
 	return false
 }
 
+// Forget drops the routes received by channel ID for the terminal term.
+// It is called when the terminal hangs up, as it is at the other end of
+// the hop.
+func (b *buffer) Forget(term string) {
+	b.Lock()
+	defer b.Unlock()
+
+	delete(b.channels, term)
+}
+
+// Reprefix replaces the prefix of b, and the start of its current routing,
+// with prefix. Both prefixes must be the same length.
+func (b *buffer) Reprefix(prefix ...*message.T) {
+	b.Lock()
+	defer b.Unlock()
+
+	bs := bytes(prefix)
+
+	b.prefix = prefix
+	b.routing = append(bs, b.routing[len(bs):]...)
+
+	copy(b.buffer, bs)
+}
+
 func (b *buffer) Routing() [][]byte {
 	b.RLock()
 	defer b.RUnlock()
@@ -0,0 +1,163 @@
+// Released under an MIT license. See LICENSE.
+
+package buffer_test
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/michaelmacinnis/summit/pkg/buffer"
+	"github.com/michaelmacinnis/summit/pkg/message"
+)
+
+func TestRoute(t *testing.T) {
+	c := buffer.NewChannels()
+	b := receiver()
+
+	for _, depth := range []int{1, 2, 8, 1, 8, 2} {
+		r := route("7", depth)
+
+		if got := send(b, c.Route(r), "x"); !equal(got, want(r)) {
+			t.Errorf("depth %d: routing %s, want %s", depth, show(got), show(want(r)))
+		}
+	}
+}
+
+func TestRouteOverhead(t *testing.T) {
+	overhead := -1
+
+	for depth := 1; depth <= 32; depth *= 2 {
+		c := buffer.NewChannels()
+		r := route("7", depth)
+
+		first := size(c.Route(r))
+
+		n := size(c.Route(r))
+		if n >= first {
+			t.Errorf("depth %d: route sent in %d bytes, then %d", depth, first, n)
+		}
+
+		if overhead < 0 {
+			overhead = n
+		} else if n != overhead {
+			t.Errorf("depth %d: %d bytes per keystroke, want %d", depth, n, overhead)
+		}
+	}
+}
+
+func TestForget(t *testing.T) {
+	c := buffer.NewChannels()
+	b := receiver()
+	r := route("7", 3)
+
+	send(b, c.Route(r), "x")
+	stale := c.Route(r)
+
+	// Both ends forget the terminal's routes when it hangs up.
+	c.Forget(r[0])
+	b.Forget("7")
+
+	if got := send(b, stale, "x"); got != nil {
+		t.Errorf("forgotten route delivered to %s", show(got))
+	}
+
+	// The route is sent again in full the next time it is used.
+	if got := send(b, c.Route(r), "x"); !equal(got, want(r)) {
+		t.Errorf("routing %s, want %s", show(got), show(want(r)))
+	}
+
+	if got := send(b, c.Route(r), "x"); !equal(got, want(r)) {
+		t.Errorf("routing %s, want %s", show(got), show(want(r)))
+	}
+}
+
+func BenchmarkKeystroke(b *testing.B) {
+	for _, depth := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("depth=%d", depth), func(b *testing.B) {
+			c := buffer.NewChannels()
+			dst := receiver()
+			r := route("7", depth)
+
+			send(dst, c.Route(r), "x")
+
+			wire := 0
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				bs := c.Route(r)
+				wire += size(bs)
+
+				send(dst, bs, "x")
+			}
+
+			b.ReportMetric(float64(wire)/float64(b.N), "wire-B/op")
+		})
+	}
+}
+
+func equal(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// receiver returns a buffer like that of a session reading from a nested mux.
+func receiver() *buffer.T {
+	return buffer.New(message.From(message.Term{}), message.From(message.Pty{ID: "1"}))
+}
+
+// route returns a route to terminal term through depth muxes.
+func route(term string, depth int) [][]byte {
+	r := [][]byte{message.Term{ID: term}.Bytes()}
+	for i := 0; i < depth; i++ {
+		r = append(r, message.Pty{ID: strconv.Itoa(i)}.Bytes())
+	}
+
+	return r
+}
+
+// send passes routing and then text to b and returns the routing that
+// b delivers the text to, if any.
+func send(b *buffer.T, routing [][]byte, text string) [][]byte {
+	for _, r := range routing {
+		if !b.Buffered(message.Raw(r)) {
+			panic("routing not buffered: " + string(r))
+		}
+	}
+
+	if b.Buffered(message.New(message.Text, []byte(text))) {
+		return nil
+	}
+
+	return b.Routing()
+}
+
+func show(routing [][]byte) string {
+	return string(bytes.Join(routing, []byte(" ")))
+}
+
+func size(routing [][]byte) int {
+	n := 0
+	for _, b := range routing {
+		n += len(b)
+	}
+
+	return n
+}
+
+// want returns the routing a receiver delivers to for route r.
+func want(r [][]byte) [][]byte {
+	return append([][]byte{r[0], message.Pty{ID: "1"}.Bytes()}, r[1:]...)
+}
@@ -0,0 +1,78 @@
+// Released under an MIT license. See LICENSE.
+
+package buffer
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/michaelmacinnis/summit/pkg/message"
+)
+
+// Channels assigns channel IDs to the routes sent on a single hop so that
+// each route is only sent once. See message.Channel.
+type Channels struct {
+	sync.Mutex
+
+	ids  map[string]map[string]string // By terminal, then by route.
+	next uint64
+}
+
+// NewChannels creates a channel ID assigner for a hop.
+func NewChannels() *Channels {
+	return &Channels{ids: map[string]map[string]string{}}
+}
+
+// Forget drops the channel IDs of routes to the terminal term. It is
+// called when the terminal hangs up, as it is at the other end of the
+// hop, so that routes to it are sent in full if it is ever seen again.
+func (c *Channels) Forget(term []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	delete(c.ids, string(term))
+}
+
+// Route returns what to send in place of routing. The first time a route
+// is sent it is followed by a new channel ID. After that it is replaced
+// by its terminal ID, if any, and channel ID.
+func (c *Channels) Route(routing [][]byte) [][]byte {
+	n := 0
+	if len(routing) > 0 && message.Raw(routing[0]).IsTerm() {
+		n = 1
+	}
+
+	if len(routing) == n {
+		return routing
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	t := ""
+	if n > 0 {
+		t = string(routing[0])
+	}
+
+	k := ""
+	for _, b := range routing[n:] {
+		k += string(b)
+	}
+
+	ids := c.ids[t]
+	if ids == nil {
+		ids = map[string]string{}
+		c.ids[t] = ids
+	}
+
+	id, ok := ids[k]
+	if ok {
+		return append(append([][]byte{}, routing[:n]...), message.Channel{ID: id}.Bytes())
+	}
+
+	c.next++
+	id = strconv.FormatUint(c.next, 36) //nolint:gomnd
+	ids[k] = id
+
+	return append(append([][]byte{}, routing...), message.Channel{ID: id}.Bytes())
+}
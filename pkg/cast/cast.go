@@ -0,0 +1,221 @@
+// Released under an MIT license. See LICENSE.
+
+// Package cast reads and writes asciicast v2 files, the format recorded
+// and played by asciinema. See https://docs.asciinema.org/manual/asciicast/v2/.
+package cast
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+// Event kinds.
+const (
+	Output = "o"
+	Resize = "r"
+)
+
+const version = 2
+
+// ErrMalformed is returned when a file is not in asciicast v2 format.
+var ErrMalformed = errors.New("malformed asciicast")
+
+// Event is a line, after the header, of an asciicast file.
+type Event struct {
+	Time float64 // Seconds since the start of the recording.
+	Kind string
+	Data string
+}
+
+// Header is the first line of an asciicast file.
+type Header struct {
+	Version       int     `json:"version"`
+	Width         int     `json:"width"`
+	Height        int     `json:"height"`
+	Timestamp     int64   `json:"timestamp,omitempty"`
+	IdleTimeLimit float64 `json:"idle_time_limit,omitempty"`
+	Title         string  `json:"title,omitempty"`
+}
+
+// T records a session to an asciicast file.
+type T struct {
+	c io.Closer
+	w *bufio.Writer
+
+	// Bytes at the end of the last output that don't yet make up a
+	// whole character. Events must be valid UTF-8.
+	partial []byte
+
+	start time.Time
+}
+
+// Create creates the file at path and starts recording to it.
+func Create(path string, width, height int, title string) (*T, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600) //nolint:gomnd
+	if err != nil {
+		return nil, err
+	}
+
+	t, err := New(f, width, height, title)
+	if err != nil {
+		f.Close()
+
+		return nil, err
+	}
+
+	t.c = f
+
+	return t, nil
+}
+
+// New starts a recording, with the given terminal size, on w.
+func New(w io.Writer, width, height int, title string) (*T, error) {
+	t := &T{
+		start: time.Now(),
+		w:     bufio.NewWriter(w),
+	}
+
+	j, err := json.Marshal(Header{
+		Version:   version,
+		Width:     width,
+		Height:    height,
+		Timestamp: t.start.Unix(),
+		Title:     title,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := t.w.Write(append(j, '\n')); err != nil {
+		return nil, err
+	}
+
+	return t, t.w.Flush()
+}
+
+// Read reads an asciicast file.
+func Read(r io.Reader) (*Header, []Event, error) {
+	d := json.NewDecoder(r)
+
+	h := &Header{}
+	if err := d.Decode(h); err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", ErrMalformed, err.Error())
+	} else if h.Version != version {
+		return nil, nil, fmt.Errorf("%w: version %d", ErrMalformed, h.Version)
+	}
+
+	events := []Event{}
+
+	for {
+		e := Event{}
+
+		err := d.Decode(&e)
+		if errors.Is(err, io.EOF) {
+			return h, events, nil
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("%w: %s", ErrMalformed, err.Error())
+		}
+
+		events = append(events, e)
+	}
+}
+
+// Close ends the recording. If it was created by Create, the file is
+// closed.
+func (t *T) Close() error {
+	err := t.w.Flush()
+
+	if t.c != nil {
+		if cerr := t.c.Close(); err == nil {
+			err = cerr
+		}
+	}
+
+	return err
+}
+
+// Output records b as written to the terminal.
+func (t *T) Output(b []byte) error {
+	b = append(t.partial, b...)
+	t.partial = nil
+
+	// Hold back a character split across writes.
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				t.partial = append([]byte{}, b[i:]...)
+				b = b[:i]
+			}
+
+			break
+		}
+	}
+
+	if len(b) == 0 {
+		return nil
+	}
+
+	return t.event(Output, string(b))
+}
+
+// Resize records a change in the size of the terminal.
+func (t *T) Resize(width, height int) error {
+	return t.event(Resize, fmt.Sprintf("%dx%d", width, height))
+}
+
+func (t *T) event(kind, data string) error {
+	j, err := json.Marshal(Event{time.Since(t.start).Seconds(), kind, data})
+	if err != nil {
+		return err
+	}
+
+	if _, err = t.w.Write(append(j, '\n')); err != nil {
+		return err
+	}
+
+	return t.w.Flush()
+}
+
+// MarshalJSON writes e as a JSON array of its time, kind, and data.
+func (e Event) MarshalJSON() ([]byte, error) {
+	kind, err := json.Marshal(e.Kind)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := json.Marshal(e.Data)
+	if err != nil {
+		return nil, err
+	}
+
+	s := "[" + strconv.FormatFloat(e.Time, 'f', 6, 64) + ", " + string(kind) + ", " + string(data) + "]" //nolint:gomnd
+
+	return []byte(s), nil
+}
+
+// UnmarshalJSON reads e from a JSON array of its time, kind, and data.
+func (e *Event) UnmarshalJSON(b []byte) error {
+	a := []json.RawMessage{}
+	if err := json.Unmarshal(b, &a); err != nil {
+		return err
+	} else if len(a) != 3 { //nolint:gomnd
+		return fmt.Errorf("%w: event has %d fields", ErrMalformed, len(a))
+	}
+
+	if err := json.Unmarshal(a[0], &e.Time); err != nil {
+		return err
+	}
+
+	if err := json.Unmarshal(a[1], &e.Kind); err != nil {
+		return err
+	}
+
+	return json.Unmarshal(a[2], &e.Data)
+}
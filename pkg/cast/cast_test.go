@@ -0,0 +1,125 @@
+// Released under an MIT license. See LICENSE.
+
+package cast_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/michaelmacinnis/summit/pkg/cast"
+)
+
+func TestEvent(t *testing.T) {
+	events := []cast.Event{
+		{Time: 0, Kind: cast.Output, Data: "plain"},
+		{Time: 1.5, Kind: cast.Output, Data: "\x1b[1;31mred\x1b[0m\r\n"},
+		{Time: 2.25, Kind: cast.Output, Data: "\"quoted\" \\ При"},
+		{Time: 3, Kind: cast.Resize, Data: "80x24"},
+	}
+
+	for _, want := range events {
+		b, err := json.Marshal(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		got := cast.Event{}
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatalf("%s: %v", b, err)
+		}
+
+		if got != want {
+			t.Errorf("%s: got %+v, want %+v", b, got, want)
+		}
+	}
+
+	e := cast.Event{}
+	for _, s := range []string{`[1, "o"]`, `[1, "o", "a", "b"]`} {
+		if err := json.Unmarshal([]byte(s), &e); !errors.Is(err, cast.ErrMalformed) {
+			t.Errorf("%s: got %v, want %v", s, err, cast.ErrMalformed)
+		}
+	}
+
+	if err := json.Unmarshal([]byte(`{"time": 1}`), &e); err == nil {
+		t.Error("expected an error for an object")
+	}
+}
+
+func TestOutput(t *testing.T) {
+	b := &bytes.Buffer{}
+
+	c, err := cast.New(b, 80, 24, "title") //nolint:gomnd
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// "П" is d0 9f and "€" is e2 82 ac. Both are split across writes.
+	for _, s := range []string{"a\xd0", "\x9fb\xe2", "\x82", "\xac", "c"} {
+		if err := c.Output([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := c.Resize(100, 30); err != nil { //nolint:gomnd
+		t.Fatal(err)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	h, events, err := cast.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if h.Version != 2 || h.Width != 80 || h.Height != 24 || h.Title != "title" {
+		t.Errorf("got header %+v", h)
+	}
+
+	want := []cast.Event{
+		{Kind: cast.Output, Data: "a"},
+		{Kind: cast.Output, Data: "Пb"},
+		{Kind: cast.Output, Data: "€"},
+		{Kind: cast.Output, Data: "c"},
+		{Kind: cast.Resize, Data: "100x30"},
+	}
+
+	if len(events) != len(want) {
+		t.Fatalf("got %d events, want %d: %+v", len(events), len(want), events)
+	}
+
+	for i, e := range events {
+		if e.Kind != want[i].Kind || e.Data != want[i].Data {
+			t.Errorf("event %d: got %+v, want %+v", i, e, want[i])
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		ok   bool
+	}{
+		{"valid", "{\"version\": 2, \"width\": 80, \"height\": 24}\n[0.5, \"o\", \"x\"]\n", true},
+		{"header only", "{\"version\": 2, \"width\": 80, \"height\": 24}\n", true},
+		{"version 1", "{\"version\": 1, \"width\": 80, \"height\": 24}\n", false},
+		{"no version", "{\"width\": 80, \"height\": 24}\n", false},
+		{"not json", "$ ls\r\n", false},
+		{"bad event", "{\"version\": 2}\n[0.5, \"o\"]\n", false},
+		{"empty", "", false},
+	}
+
+	for _, test := range tests {
+		_, _, err := cast.Read(strings.NewReader(test.in))
+		if test.ok && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		} else if !test.ok && !errors.Is(err, cast.ErrMalformed) {
+			t.Errorf("%s: got %v, want %v", test.name, err, cast.ErrMalformed)
+		}
+	}
+}
@@ -3,6 +3,7 @@
 package comms
 
 import (
+	"bytes"
 	"io"
 	"strconv"
 
@@ -56,38 +57,139 @@ func Reader(r io.Reader, f func(b []byte)) {
 	f(nil)
 }
 
-func Chunk(r io.Reader) chan *message.T {
-	c := make(chan *message.T)
+// Chunk returns a channel of messages read from r. Messages are scanned
+// by the lexer. Control messages framed with c, as well as those in any
+// 7-bit carrier, are recognised.
+func Chunk(r io.Reader, c message.Carrier) chan *message.T {
+	return chunk(r, nil, c)
+}
 
-	l := lexer.New()
+// Join returns a ReadWriteCloser that reads from r and writes to w.
+// Closing it closes both.
+func Join(r io.ReadCloser, w io.WriteCloser) io.ReadWriteCloser {
+	return &joined{r, w}
+}
 
-	go Reader(r, func(b []byte) {
-		if b != nil {
-			l.Scan(b)
-			for t := l.Chunk(); t != nil; t = l.Chunk() {
-				c <- t
+// Pipe returns a channel of messages read from r, the pipe between the
+// server and a mux. Messages are scanned by the lexer until a binary
+// message signed with k is read. After that they are decoded from binary
+// framing. Nothing else ever switches to binary framing, so output that
+// looks like a binary message can't stop a stream from being scanned.
+func Pipe(r io.Reader, k message.Key, c message.Carrier) chan *message.T {
+	return chunk(r, k, c)
+}
+
+// Prefer receives from hi if a message is waiting there, otherwise from
+// whichever of hi or lo is ready first. The last result is true if the
+// message came from hi. Preferring input over output means that, under a
+// flood of output, input waits for at most one output message.
+func Prefer(hi, lo <-chan *message.T) (*message.T, bool, bool) {
+	select {
+	case m, ok := <-hi:
+		return m, ok, true
+	default:
+	}
+
+	select {
+	case m, ok := <-hi:
+		return m, ok, true
+	case m, ok := <-lo:
+		return m, ok, false
+	}
+}
+
+// Queue passes on the messages sent to in, in order, without blocking the
+// sender. The returned channel is closed after in is closed and what was
+// queued has been received. Nothing here bounds what is queued. A sender
+// that needs a bound gets it from credit. See message.Window.
+func Queue(in <-chan *message.T) chan *message.T {
+	out := make(chan *message.T)
+
+	go func() {
+		defer close(out)
+
+		q := []*message.T{}
+
+		for in != nil || len(q) > 0 {
+			next, send := (*message.T)(nil), (chan *message.T)(nil)
+			if len(q) > 0 {
+				next, send = q[0], out
+			}
+
+			select {
+			case m, ok := <-in:
+				if !ok {
+					in = nil
+
+					continue
+				}
+
+				q = append(q, m)
+
+			case send <- next:
+				q[0] = nil
+				q = q[1:]
 			}
-		} else {
-			close(c)
 		}
-	})
+	}()
 
-	return c
+	return out
+}
+
+// Wrap returns a WriteCloser that wraps each control message written
+// to wc so that it passes through p.
+func Wrap(wc io.WriteCloser, p message.Passthrough) io.WriteCloser {
+	if p == message.Direct {
+		return wc
+	}
+
+	return &wrapper{wc, p}
 }
 
-func Write(wc io.WriteCloser, ds ...chan struct{}) chan [][]byte {
-	c := make(chan [][]byte)
+// Write returns a channel, the contents of which are written to wc.
+// Control messages are signed with k and framed with carrier c before
+// being written. Once message.Binary{} is written everything after it
+// is in binary framing. In binary framing, every message in a slice that
+// starts with a terminal ID is addressed to that terminal.
+func Write(wc io.WriteCloser, k message.Key, c message.Carrier, ds ...chan struct{}) chan [][]byte {
+	w := make(chan [][]byte)
 
 	go func() {
 		defer wc.Close()
 
-		for bs := range c {
+		binary := false
+
+		// Every writer switches with the same message. Comparing
+		// bytes is cheaper than decoding everything written.
+		switches := message.Binary{}.Bytes()
+
+		for bs := range w {
+			address := ""
+			if binary && len(bs) > 0 {
+				if t, ok := message.As[*message.Term](message.Raw(bs[0])); ok {
+					address = t.ID
+				}
+			}
+
 			for _, b := range bs {
-				if b != nil {
-					_, err := wc.Write(b)
-					if err != nil {
-						println(err.Error())
-					}
+				if b == nil {
+					continue
+				}
+
+				s := []byte(nil)
+				if binary {
+					s = message.Encode(b, k, address)
+				} else {
+					s = c.Carry(k.Sign(b))
+				}
+
+				_, err := wc.Write(s)
+				if err != nil {
+					println(err.Error())
+				}
+
+				if !binary {
+					binary = bytes.Equal(b, switches)
 				}
 			}
 		}
@@ -98,5 +200,88 @@ func Write(wc io.WriteCloser, ds ...chan struct{}) chan [][]byte {
 		}
 	}()
 
+	return w
+}
+
+// chunk scans r and, if k is not nil, switches to binary framing after
+// a binary message signed with k.
+func chunk(r io.Reader, k message.Key, carrier message.Carrier) chan *message.T {
+	c := make(chan *message.T)
+
+	d := (*message.Decoder)(nil)
+	l := lexer.New(carrier)
+
+	go Reader(r, func(b []byte) {
+		if b == nil {
+			if d == nil {
+				if t := l.Flush(); t != nil {
+					c <- t
+				}
+			}
+
+			close(c)
+
+			return
+		}
+
+		if d == nil {
+			l.Scan(b)
+			for t := l.Chunk(); t != nil; t = l.Chunk() {
+				// Checked before t is passed on and may be in use.
+				binary := k != nil && t.IsBinary() && k.Verify(t)
+
+				c <- t
+
+				if binary {
+					d = &message.Decoder{}
+					b = l.Rest()
+
+					break
+				}
+			}
+
+			if d == nil {
+				return
+			}
+		}
+
+		d.Scan(b)
+		for t := d.Chunk(); t != nil; t = d.Chunk() {
+			c <- t
+		}
+	})
+
 	return c
 }
+
+type joined struct {
+	io.ReadCloser
+	w io.WriteCloser
+}
+
+func (j *joined) Close() error {
+	err := j.w.Close()
+
+	if rerr := j.ReadCloser.Close(); err == nil {
+		err = rerr
+	}
+
+	return err
+}
+
+func (j *joined) Write(b []byte) (int, error) {
+	return j.w.Write(b)
+}
+
+type wrapper struct {
+	io.WriteCloser
+	p message.Passthrough
+}
+
+func (w *wrapper) Write(b []byte) (int, error) {
+	if _, err := w.WriteCloser.Write(w.p.Wrap(b)); err != nil {
+		return 0, err
+	}
+
+	return len(b), nil
+}
@@ -0,0 +1,168 @@
+// Released under an MIT license. See LICENSE.
+
+package comms_test
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/michaelmacinnis/summit/pkg/comms"
+	"github.com/michaelmacinnis/summit/pkg/message"
+)
+
+func TestPrefer(t *testing.T) {
+	hi := make(chan *message.T, 1)
+	lo := make(chan *message.T, 1)
+
+	lo <- message.New(message.Text, []byte("output"))
+	hi <- message.New(message.Text, []byte("input"))
+
+	if m, ok, input := comms.Prefer(hi, lo); !ok || !input || string(m.Bytes()) != "input" {
+		t.Errorf("got %v, %v, %v, want input first", m, ok, input)
+	}
+
+	if m, ok, input := comms.Prefer(hi, lo); !ok || input || string(m.Bytes()) != "output" {
+		t.Errorf("got %v, %v, %v, want output", m, ok, input)
+	}
+
+	close(hi)
+
+	if _, ok, input := comms.Prefer(hi, lo); ok || !input {
+		t.Errorf("got %v, %v, want closed input", ok, input)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	in := make(chan *message.T)
+	out := comms.Queue(in)
+
+	// Sending never waits for the receiver.
+	for i := 0; i < 1000; i++ {
+		in <- message.New(message.Text, []byte{byte(i)})
+	}
+
+	close(in)
+
+	n := 0
+	for m := range out {
+		if m.Bytes()[0] != byte(n) {
+			t.Fatalf("message %d out of order", n)
+		}
+		n++
+	}
+
+	if n != 1000 {
+		t.Errorf("received %d messages, want 1000", n)
+	}
+}
+
+func TestWriteBinary(t *testing.T) {
+	r, w := io.Pipe()
+	defer r.Close()
+
+	k := message.NewKey()
+	out := comms.Write(w, k, message.PM)
+
+	// Only the binary message itself switches. A control message that
+	// merely looks like it, like one quoted as text, doesn't.
+	quoted := message.Quote(message.Binary{}.Bytes())
+	pty := message.Pty{ID: "1"}.Bytes()
+
+	go func() {
+		out <- [][]byte{quoted, pty}
+		out <- [][]byte{message.Binary{}.Bytes()}
+		out <- [][]byte{[]byte("after")}
+		close(out)
+	}()
+
+	got, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := bytes.Join([][]byte{
+		quoted,
+		k.Sign(pty),
+		k.Sign(message.Binary{}.Bytes()),
+		message.Encode([]byte("after"), k, ""),
+	}, nil)
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+// Input reaches a session flooded with output, from a program that never
+// stops writing to a terminal that is slow to read, within a bound. Taken
+// in order, the output ahead of the last keystroke would take seconds.
+func TestPreferLatency(t *testing.T) {
+	const (
+		keys  = 20
+		limit = 50 * time.Millisecond
+		write = 200 * time.Microsecond // To the slow terminal.
+	)
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+
+	go func() {
+		line := bytes.Repeat([]byte("flood "), 10)
+		for {
+			if _, err := pw.Write(line); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Let output queue up before typing.
+	output := comms.Queue(comms.Chunk(pr, message.PM))
+	time.Sleep(50 * time.Millisecond)
+
+	ir, iw := io.Pipe()
+	input := comms.Chunk(ir, message.PM)
+
+	sent := make(chan time.Time, keys)
+
+	go func() {
+		defer iw.Close()
+
+		for i := 0; i < keys; i++ {
+			sent <- time.Now()
+			if _, err := iw.Write([]byte{'a' + byte(i)}); err != nil {
+				return
+			}
+
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+
+	worst := time.Duration(0)
+
+	for n := 0; n < keys; {
+		m, ok, typed := comms.Prefer(input, output)
+		if !ok {
+			t.Fatal("stream closed")
+		}
+
+		if !typed {
+			time.Sleep(write)
+
+			continue
+		}
+
+		n += len(m.Bytes())
+		for i := 0; i < len(m.Bytes()); i++ {
+			if d := time.Since(<-sent); d > worst {
+				worst = d
+			}
+		}
+	}
+
+	t.Logf("worst input latency %v", worst)
+
+	if worst > limit {
+		t.Errorf("input took %v to arrive under a flood of output, want at most %v", worst, limit)
+	}
+}
@@ -0,0 +1,445 @@
+// Released under an MIT license. See LICENSE.
+
+package comms
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Frame kinds. Every frame starts with its kind and a stream offset.
+// Data frames follow that with a length and the data itself.
+const (
+	ack  = 'a' // Offset is the number of bytes read by the peer.
+	data = 'd' // Offset is the position of the data in the stream.
+	end  = 'e' // The peer has closed the stream.
+)
+
+const (
+	ackEvery = window / 4 //nolint:gomnd
+	maxFrame = blocksz
+	window   = 1 << 20 // Bytes written but not yet acknowledged.
+)
+
+var (
+	ErrGap       = errors.New("data missing from stream")
+	ErrHandshake = errors.New("resume failed")
+)
+
+// Reliable is a stream that survives the failure of the transport under
+// it. Data written is kept until the peer acknowledges it. When a new
+// transport is attached, each side tells the other how much it has
+// received and the rest is sent again.
+//
+// Transports must be binary clean. A pipe or socket will do. A terminal
+// will not.
+type Reliable struct {
+	sync.Mutex
+
+	cond *sync.Cond
+	kick chan struct{}
+
+	// Serializes writes to the transport so that data is sent in order.
+	w sync.Mutex
+
+	t io.ReadWriteCloser // Current transport, if any.
+
+	acked   uint64 // Bytes the peer has read.
+	pending []byte // Bytes written since acked.
+
+	input    []byte // Bytes received but not yet read.
+	read     uint64 // Bytes read.
+	received uint64 // Bytes received.
+	reported uint64 // Bytes read as of the last ack sent.
+
+	closed bool
+	eof    bool
+}
+
+func NewReliable() *Reliable {
+	r := &Reliable{kick: make(chan struct{}, 1)}
+	r.cond = sync.NewCond(r)
+
+	go r.acknowledge()
+
+	return r
+}
+
+// Attach makes t the transport for r, replacing the current transport,
+// if any, and resends anything the peer has not received. It returns
+// when t fails or the stream is closed. In the latter case it returns nil.
+func (r *Reliable) Attach(t io.ReadWriteCloser) error {
+	br := bufio.NewReader(t)
+
+	if err := r.handshake(t, br); err != nil {
+		if r.detach(t) {
+			return nil
+		}
+
+		return fmt.Errorf("%w: %s", ErrHandshake, err.Error())
+	}
+
+	for {
+		kind, offset, b, err := next(br)
+		if err != nil {
+			if r.detach(t) {
+				return nil
+			}
+
+			return err
+		}
+
+		r.Lock()
+
+		switch kind {
+		case ack:
+			err = r.trim(offset)
+
+		case data:
+			err = r.receive(offset, b)
+
+		case end:
+			r.eof = true
+		}
+
+		r.cond.Broadcast()
+		r.Unlock()
+
+		if err != nil {
+			r.detach(t)
+
+			return err
+		}
+	}
+}
+
+// Close closes the stream. The peer reads io.EOF once it has read
+// everything written before Close. If there is no transport, that
+// happens on the next attach.
+func (r *Reliable) Close() error {
+	r.w.Lock()
+	defer r.w.Unlock()
+
+	r.Lock()
+	t := r.t
+	r.closed = true
+	r.t = nil
+	r.cond.Broadcast()
+	r.Unlock()
+
+	r.poke()
+
+	if t == nil {
+		return nil
+	}
+
+	_ = frame(t, end, 0, nil) // Best effort.
+
+	return t.Close()
+}
+
+func (r *Reliable) Read(b []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	for len(r.input) == 0 && !r.eof && !r.closed {
+		r.cond.Wait()
+	}
+
+	if len(r.input) == 0 {
+		return 0, io.EOF
+	}
+
+	n := copy(b, r.input)
+	r.input = r.input[n:]
+	r.read += uint64(n)
+
+	if r.read-r.reported >= ackEvery {
+		r.poke()
+	}
+
+	return n, nil
+}
+
+func (r *Reliable) Write(b []byte) (int, error) {
+	written := 0
+
+	for len(b) > 0 {
+		n := len(b)
+		if n > maxFrame {
+			n = maxFrame
+		}
+
+		// Wait for room before serializing so that acks still go out.
+		r.Lock()
+		for len(r.pending) >= window && !r.closed {
+			r.cond.Wait()
+		}
+		r.Unlock()
+
+		r.w.Lock()
+
+		r.Lock()
+		if r.closed {
+			r.Unlock()
+			r.w.Unlock()
+
+			return written, io.ErrClosedPipe
+		}
+
+		offset := r.acked + uint64(len(r.pending))
+		r.pending = append(r.pending, b[:n]...)
+		t := r.t
+		r.Unlock()
+
+		// Data that can't be sent now is sent on the next attach.
+		if t != nil && frame(t, data, offset, b[:n]) != nil {
+			r.detach(t)
+		}
+
+		r.w.Unlock()
+
+		b = b[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+// Acks are sent from their own goroutine so that reading never waits
+// on writing.
+func (r *Reliable) acknowledge() {
+	for range r.kick {
+		r.w.Lock()
+
+		r.Lock()
+		closed := r.closed
+		t := r.t
+		read := r.read
+		r.reported = read
+		r.Unlock()
+
+		if t != nil && frame(t, ack, read, nil) != nil {
+			r.detach(t)
+		}
+
+		r.w.Unlock()
+
+		if closed {
+			return
+		}
+	}
+}
+
+// handshake exchanges the number of bytes received with the
+// peer over t and makes t the current transport. Anything the peer has
+// not received is resent from another goroutine so that reading from t
+// can start right away. Until then nothing else is written to t.
+//
+// Both sides send their ack at once, so it is written from another
+// goroutine. Otherwise a transport that does not buffer would deadlock.
+func (r *Reliable) handshake(t io.ReadWriteCloser, br *bufio.Reader) error {
+	r.Lock()
+	received := r.received
+	r.Unlock()
+
+	sent := make(chan error, 1)
+	go func() {
+		sent <- frame(t, ack, received, nil)
+	}()
+
+	// On error, the caller closes t, which ends the write, if blocked.
+	kind, offset, _, err := next(br)
+	if err != nil {
+		return err
+	} else if kind != ack {
+		return fmt.Errorf("expected ack got %q", kind)
+	}
+
+	if err := <-sent; err != nil {
+		return err
+	}
+
+	// A write blocked on the old transport, as on a link that has
+	// dropped, holds r.w until the transport is closed.
+	r.Lock()
+	old := r.t
+	r.t = nil
+	r.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	r.w.Lock()
+
+	r.Lock()
+	defer r.Unlock()
+
+	if offset < r.acked {
+		r.w.Unlock()
+
+		// The peer has lost data it acknowledged. It may be new.
+		return ErrGap
+	}
+
+	if err := r.trim(offset); err != nil {
+		r.w.Unlock()
+
+		return err
+	}
+
+	r.cond.Broadcast()
+
+	if r.t != nil {
+		r.t.Close()
+	}
+
+	r.t = t
+
+	go r.replay(t, r.acked, r.pending, r.closed)
+
+	return nil
+}
+
+// replay is called with r.w locked and unlocks it when done.
+func (r *Reliable) replay(t io.ReadWriteCloser, offset uint64, b []byte, closed bool) {
+	defer r.w.Unlock()
+
+	err := frame(t, data, offset, b)
+	if err == nil && closed {
+		err = frame(t, end, 0, nil)
+	}
+
+	if err != nil {
+		r.detach(t)
+	}
+}
+
+// detach drops t if it is still the current transport. It
+// returns true if the stream has been closed.
+func (r *Reliable) detach(t io.ReadWriteCloser) bool {
+	r.Lock()
+	if r.t == t {
+		r.t = nil
+	}
+	done := r.closed || r.eof
+	r.Unlock()
+
+	t.Close()
+
+	return done
+}
+
+func (r *Reliable) poke() {
+	select {
+	case r.kick <- struct{}{}:
+	default:
+	}
+}
+
+// receive is called with r locked.
+func (r *Reliable) receive(offset uint64, b []byte) error {
+	if offset > r.received {
+		return ErrGap
+	}
+
+	// Skip anything already received.
+	if skip := r.received - offset; skip < uint64(len(b)) {
+		r.input = append(r.input, b[skip:]...)
+		r.received += uint64(len(b)) - skip
+	}
+
+	return nil
+}
+
+// trim is called with r locked.
+func (r *Reliable) trim(offset uint64) error {
+	if offset < r.acked {
+		return nil
+	}
+
+	n := offset - r.acked
+	if n > uint64(len(r.pending)) {
+		return ErrGap
+	}
+
+	r.pending = append([]byte(nil), r.pending[n:]...)
+	r.acked = offset
+
+	return nil
+}
+
+func frame(w io.Writer, kind byte, offset uint64, b []byte) error {
+	for {
+		n := len(b)
+		if n > maxFrame {
+			n = maxFrame
+		}
+
+		var hdr [13]byte
+
+		hdr[0] = kind
+		binary.BigEndian.PutUint64(hdr[1:9], offset)
+
+		size := 9
+		if kind == data {
+			if n == 0 {
+				return nil
+			}
+
+			binary.BigEndian.PutUint32(hdr[9:], uint32(n))
+			size = len(hdr)
+		}
+
+		if _, err := w.Write(append(hdr[:size:size], b[:n]...)); err != nil {
+			return err
+		}
+
+		if n == len(b) {
+			return nil
+		}
+
+		b = b[n:]
+		offset += uint64(n)
+	}
+}
+
+func next(r *bufio.Reader) (byte, uint64, []byte, error) {
+	hdr := make([]byte, 9) //nolint:gomnd
+
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, 0, nil, err
+	}
+
+	kind := hdr[0]
+	offset := binary.BigEndian.Uint64(hdr[1:])
+
+	switch kind {
+	case ack, end:
+		return kind, offset, nil, nil
+
+	case data:
+		if _, err := io.ReadFull(r, hdr[:4]); err != nil {
+			return 0, 0, nil, err
+		}
+
+		n := binary.BigEndian.Uint32(hdr[:4])
+		if n > maxFrame {
+			return 0, 0, nil, fmt.Errorf("frame too long: %d", n)
+		}
+
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return 0, 0, nil, err
+		}
+
+		return kind, offset, b, nil
+	}
+
+	return 0, 0, nil, fmt.Errorf("unknown frame: %q", kind)
+}
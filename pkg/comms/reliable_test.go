@@ -0,0 +1,234 @@
+// Released under an MIT license. See LICENSE.
+
+package comms_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/michaelmacinnis/summit/pkg/comms"
+)
+
+func TestReliableResume(t *testing.T) {
+	const total = 1 << 18
+
+	a := comms.NewReliable()
+	b := comms.NewReliable()
+
+	kill := connect(a, b)
+
+	sent := stream(total)
+	go func() {
+		for i := 0; i < total; i += 1000 {
+			j := i + 1000
+			if j > total {
+				j = total
+			}
+
+			if _, err := a.Write(sent[i:j]); err != nil {
+				return
+			}
+		}
+	}()
+
+	got := make([]byte, 0, total)
+	buf := make([]byte, 777)
+
+	// Kill the pipe and start another one a few times mid-stream.
+	for restarts := 0; len(got) < total; {
+		n, err := b.Read(buf)
+		if err != nil {
+			t.Fatalf("read after %d bytes: %v", len(got), err)
+		}
+
+		got = append(got, buf[:n]...)
+
+		if restarts < 3 && len(got) > (restarts+1)*total/4 {
+			kill()
+			kill = connect(a, b)
+			restarts++
+		}
+	}
+
+	if !bytes.Equal(got, sent) {
+		t.Fatal("stream changed across restarts")
+	}
+
+	kill()
+}
+
+func TestReliableClose(t *testing.T) {
+	a := comms.NewReliable()
+	b := comms.NewReliable()
+
+	kill := connect(a, b)
+
+	if _, err := a.Write([]byte("before")); err != nil {
+		t.Fatal(err)
+	}
+
+	read(t, b, "before")
+	kill()
+
+	// Written and closed while there is no pipe.
+	if _, err := a.Write([]byte("after")); err != nil {
+		t.Fatal(err)
+	}
+
+	a.Close()
+
+	kill = connect(a, b)
+	defer kill()
+
+	read(t, b, "after")
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := b.Read(make([]byte, 1))
+		done <- err
+	}()
+
+	select {
+	case err := <-done:
+		if err != io.EOF {
+			t.Errorf("got %v, want %v", err, io.EOF)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("no EOF after the peer closed")
+	}
+}
+
+func TestReliableStalled(t *testing.T) {
+	a := comms.NewReliable()
+	b := comms.NewReliable()
+
+	p, q := net.Pipe()
+	defer p.Close()
+
+	s := &stalled{Conn: q, stuck: make(chan struct{}), closed: make(chan struct{})}
+
+	go func() { _ = a.Attach(p) }()
+	go func() { _ = b.Attach(s) }()
+
+	if _, err := a.Write([]byte("before")); err != nil {
+		t.Fatal(err)
+	}
+
+	read(t, b, "before")
+
+	// Like a dropped link, the pipe stops being read without failing
+	// and a write to it blocks.
+	close(s.stuck)
+
+	sent := stream(1 << 16)
+	go func() { _, _ = a.Write(sent) }()
+
+	time.Sleep(100 * time.Millisecond)
+
+	kill := connect(a, b)
+
+	done := make(chan error, 1)
+	go func() {
+		got := make([]byte, len(sent))
+		if _, err := io.ReadFull(b, got); err != nil {
+			done <- err
+		} else if !bytes.Equal(got, sent) {
+			done <- errors.New("stream changed across restart")
+		}
+
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("resume waited for a write to the stalled pipe")
+	}
+
+	kill()
+}
+
+// connect attaches a and b to either end of a new pipe. It returns a
+// function that kills the pipe and waits for both to notice.
+func connect(a, b *comms.Reliable) func() {
+	p, q := net.Pipe()
+
+	done := make(chan struct{}, 2) //nolint:gomnd
+	attach := func(r *comms.Reliable, t net.Conn) {
+		_ = r.Attach(t)
+		done <- struct{}{}
+	}
+
+	go attach(a, p)
+	go attach(b, q)
+
+	return func() {
+		p.Close()
+		q.Close()
+
+		<-done
+		<-done
+	}
+}
+
+func read(t *testing.T, r io.Reader, want string) {
+	t.Helper()
+
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(r, got); err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != want {
+		t.Errorf("read %q, want %q", got, want)
+	}
+}
+
+// stream returns n bytes that differ from their neighbours.
+func stream(n int) []byte {
+	b := make([]byte, n)
+	for i := range b {
+		b[i] = byte(i % 251) //nolint:gomnd
+	}
+
+	return b
+}
+
+// stalled is a connection that, once stuck is closed, stops reading
+// without failing until it is closed.
+type stalled struct {
+	net.Conn
+
+	closed chan struct{}
+	once   sync.Once
+	stuck  chan struct{}
+}
+
+// Close doesn't close the pipe. The other end doesn't hear about it, as
+// with a link that has dropped.
+func (s *stalled) Close() error {
+	s.once.Do(func() { close(s.closed) })
+
+	return nil
+}
+
+func (s *stalled) Read(b []byte) (int, error) {
+	n, err := s.Conn.Read(b)
+
+	select {
+	case <-s.stuck:
+		<-s.closed
+
+		return 0, io.EOF
+	default:
+		return n, err
+	}
+}
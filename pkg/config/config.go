@@ -4,6 +4,8 @@ import (
 	"encoding/json"
 	"flag"
 	"os"
+	"strconv"
+	"strings"
 )
 
 func Command() ([]string, bool) {
@@ -29,6 +31,18 @@ func Env(j string) []string {
 	return env
 }
 
+// Carrier returns the name of the carrier used to frame control messages
+// written to the hop between this process and its parent.
+func Carrier() string {
+	return Get("SUMMIT_CARRIER", "pm")
+}
+
+// Control returns the path to the control socket of the mux running the
+// session this process is in, if any.
+func Control() string {
+	return Get("SUMMIT_CONTROL", "")
+}
+
 func Get(k, dflt string) string {
 	if v, found := os.LookupEnv(k); found {
 		return v
@@ -37,11 +51,87 @@ func Get(k, dflt string) string {
 	return dflt
 }
 
+// Key returns the string representation of the key for the hop
+// between this process and its parent.
+func Key() string {
+	return key
+}
+
+// MaxMessage returns the maximum length of a control message.
+func MaxMessage(dflt int) int {
+	if n, err := strconv.Atoi(Get("SUMMIT_MAX_MESSAGE", "")); err == nil && n > 0 {
+		return n
+	}
+
+	return dflt
+}
+
+// Getenv returns the value of the variable k in env or dflt if not set.
+func Getenv(env []string, k, dflt string) string {
+	prefix := k + "="
+
+	for _, s := range env {
+		if strings.HasPrefix(s, prefix) {
+			return strings.TrimPrefix(s, prefix)
+		}
+	}
+
+	return dflt
+}
+
+// Passthrough returns the name of the terminal multiplexer, if any,
+// that this process is running inside of.
+func Passthrough() string {
+	if os.Getenv("TMUX") != "" {
+		return "tmux"
+	} else if os.Getenv("STY") != "" {
+		return "screen"
+	}
+
+	return ""
+}
+
+// Route returns the routing path of the session this process is in, if
+// known.
+func Route() string {
+	return Get("SUMMIT_ROUTE", "")
+}
+
 func Parse() {
 	flag.StringVar(&socket, "s", socket, "path to summit server socket")
 	flag.Parse()
 }
 
+// Setenv returns env with the variable k set to v.
+func Setenv(env []string, k, v string) []string {
+	prefix := k + "="
+
+	for i, s := range env {
+		if strings.HasPrefix(s, prefix) {
+			env[i] = prefix + v
+
+			return env
+		}
+	}
+
+	return append(env, prefix+v)
+}
+
+// Unsetenv returns a copy of env without the variable k.
+func Unsetenv(env []string, k string) []string {
+	prefix := k + "="
+
+	r := make([]string, 0, len(env))
+
+	for _, s := range env {
+		if !strings.HasPrefix(s, prefix) {
+			r = append(r, s)
+		}
+	}
+
+	return r
+}
+
 func Socket() string {
 	return socket
 }
@@ -49,5 +139,6 @@ func Socket() string {
 //nolint:gochecknoglobals
 var (
 	command = Get("SUMMIT_COMMAND", Get("SHELL", "/bin/bash"))
+	key     = Get("SUMMIT_KEY", "")
 	socket  = Get("SUMMIT_SOCKET", "/tmp/summit.socket")
 )
@@ -5,61 +5,116 @@
 // The summit lexer adapts the state function used by Go's text/template
 // lexer and described in detail in Rob Pike's talk "Lexical Scanning in
 // Go". See https://talks.golang.org/2011/lex.slide for more information.
+//
+// The scanner is byte oriented. Text is passed through in the slices
+// it arrived in and control messages are only looked for at an ESC or,
+// on a hop that uses an 8-bit carrier, an 8-bit control string introducer.
 package lexer
 
 import (
 	"bytes"
-	"unicode/utf8"
+	"sync/atomic"
 
 	"github.com/michaelmacinnis/summit/pkg/message"
 )
 
 // T holds the state of the scanner.
 type T struct {
-	bytes []byte   // Buffer being scanned.
-	first int      // Index of the current message's first byte.
-	index int      // Index of the current byte.
-	queue [][]byte // Buffers waiting to be scanned.
-	state action   // Current action.
+	bytes []byte     // Buffer being scanned.
+	c1    bool       // Set if 8-bit (C1) introducers start control strings.
+	first int        // Index of the current message's first byte.
+	index int        // Index of the current byte.
+	item  *message.T // Message waiting to be returned by Chunk.
+	state action     // Current action.
+}
 
-	messages chan *message.T
+// Counters records how often the lexer has had to recover from a bad
+// control message by emitting its bytes as text.
+type Counters struct {
+	Broken    uint64 // Framing broken part way through a message.
+	Overflow  uint64 // Message longer than Limit.
+	Truncated uint64 // Input ended part way through a message.
 }
 
-const qsize = 2
+//nolint:gochecknoglobals
+var (
+	// Limit is the maximum length of a control message. Anything
+	// longer is treated as text.
+	Limit = 1 << 20 //nolint:gomnd
 
-// New creates a new lexer/scanner.
-func New() *T {
-	return &T{state: text}
+	counts Counters
+)
+
+// New creates a new lexer/scanner for a hop whose control messages are
+// framed with c. The 8-bit introducers are only recognised on a hop that
+// uses an 8-bit carrier. Elsewhere they are just bytes of UTF-8 text.
+func New(c message.Carrier) *T {
+	return &T{c1: c.Is8Bit(), state: text}
 }
 
-// Scan passes a text buffer to the lexer for scanning.
-// If a buffer is currently being scanned, the new buffer will
-// be appended to the list of buffers waiting to be scanned.
-func (l *T) Scan(text []byte) {
-	l.queue = append(l.queue, text)
+// Scan passes a buffer to the lexer for scanning. The lexer takes
+// ownership of the buffer. Messages returned by Chunk refer to it
+// rather than to a copy, so it must not be modified after Scan.
+func (l *T) Scan(b []byte) {
+	if l.first == len(l.bytes) {
+		l.bytes = b
+		l.index = 0
+	} else {
+		// Only a partial control message is ever left over.
+		l.bytes = append(l.bytes[l.first:], b...)
+		l.index -= l.first
+	}
+
+	l.first = 0
 }
 
 // Chunk returns the next scanned message, or nil if no message is available.
 func (l *T) Chunk() *message.T {
-	for {
-		l.gather()
-
-		if len(l.bytes) == 0 {
-			return nil
+	for l.item == nil {
+		state := l.state(l)
+		if state == nil {
+			break
 		}
 
-		select {
-		case t := <-l.messages:
-			return t
+		l.state = state
+	}
 
-		default:
-			state := l.state(l)
-			if state != nil {
-				l.state = state
-			} else {
-				close(l.messages)
-			}
-		}
+	m := l.item
+	l.item = nil
+
+	return m
+}
+
+// Flush returns anything not yet emitted as text and resets the lexer.
+// This is used at the end of input so that a truncated control message
+// is not lost.
+func (l *T) Flush() *message.T {
+	rest := l.Rest()
+	if len(rest) == 0 {
+		return nil
+	}
+
+	atomic.AddUint64(&counts.Truncated, 1)
+
+	return message.New(message.Text, rest)
+}
+
+// Rest returns any bytes not yet scanned and resets the lexer.
+// This is used when switching to a different framing.
+func (l *T) Rest() []byte {
+	rest := l.bytes[l.first:]
+
+	*l = T{c1: l.c1, state: text}
+
+	return rest
+}
+
+// Stats returns the lexer's recovery counts for this process.
+func Stats() Counters {
+	return Counters{
+		Broken:    atomic.LoadUint64(&counts.Broken),
+		Overflow:  atomic.LoadUint64(&counts.Overflow),
+		Truncated: atomic.LoadUint64(&counts.Truncated),
 	}
 }
 
@@ -67,50 +122,38 @@ type action func(*T) action
 
 const eof = -1
 
-func (l *T) accept(r rune, w int) {
-	l.index += w
-}
+//nolint:gochecknoglobals
+var (
+	empty  = []byte("{}")                                // A control message with no contents.
+	joint  = []byte{message.ESC, '\\', message.ESC, 'P'} // Between screen DCS strings.
+	st     = joint[:2]                                   // String terminator.
+	prefix = []byte("tmux;")                             // Start of a tmux DCS string.
+)
 
 func (l *T) emit(c message.Class, v []byte) {
 	if len(v) == 0 {
 		return
 	}
 
-	if c == message.Command && len(v) == 8 {
+	if c == message.Command && bytes.Contains(v, empty) {
 		c = message.End
 	}
 
-	l.messages <- message.New(c, v)
-	l.skip()
-}
-
-func (l *T) gather() {
-	if len(l.queue) == 0 {
-		return
-	}
-
-	length := len(l.bytes)
-	bytes := bytes.Join(l.queue, nil)
-
-	if length > 0 && l.first < length {
-		// Prepend leftover to new bytes.
-		bytes = append(l.bytes[l.first:], bytes...)
+	if c == message.Command {
+		l.item = message.Scanned(v, v)
+	} else {
+		l.item = message.New(c, v)
 	}
 
-	l.queue = nil
-	l.bytes = bytes
-	l.index -= l.first
-	l.first = 0
-	l.messages = make(chan *message.T, qsize)
+	l.skip()
 }
 
-func (l *T) peek() (rune, int) {
-	r, w := rune(eof), 0
+func (l *T) peek() int {
 	if l.index < len(l.bytes) {
-		r, w = utf8.DecodeRune(l.bytes[l.index:])
+		return int(l.bytes[l.index])
 	}
 
-	return r, w
+	return eof
 }
 
 func (l *T) skip() {
@@ -118,116 +161,317 @@ func (l *T) skip() {
 }
 
 func (l *T) text() []byte {
-	return l.bytes[l.first:l.index]
+	// Cap the slice so that appending to a message can't clobber
+	// the bytes after it.
+	return l.bytes[l.first:l.index:l.index]
+}
+
+// tmux unwraps a control message wrapped in DCS "tmux;" with ESC doubled.
+func tmux(l *T) action {
+	rest := l.bytes[l.index:]
+
+	if len(rest) < len(prefix) {
+		if bytes.HasPrefix(prefix, rest) {
+			return nil
+		}
+
+		return text
+	} else if !bytes.HasPrefix(rest, prefix) {
+		return text
+	}
+
+	b := []byte{}
+
+	for i := l.index + len(prefix); ; i++ {
+		n := bytes.IndexByte(l.bytes[i:], message.ESC)
+		if n == -1 || i+n+1 == len(l.bytes) {
+			return wait(l)
+		}
+
+		b = append(b, l.bytes[i:i+n+1]...)
+		i += n + 1
+
+		switch l.bytes[i] {
+		case message.ESC:
+			// Doubled.
+
+		case '\\':
+			return unwrapped(l, b[:len(b)-1], i+1)
+
+		default:
+			return broken(l)
+		}
+	}
+}
+
+// wait waits for more of a wrapped control message unless it is too long.
+func wait(l *T) action {
+	if len(l.bytes)-l.first >= Limit {
+		return resync(l, &counts.Overflow)
+	}
+
+	return nil
 }
 
 // T states.
 
 func afterCloseBrace(l *T) action {
-	return on(l, '-', afterCloseBraceDash)
+	return on(l, '-', afterCloseBraceDash, broken)
 }
 
 func afterCloseBraceDash(l *T) action {
-	return on(l, message.ESC, afterCloseBraceDashEscape)
+	switch l.peek() {
+	case eof:
+		return nil
+
+	case message.ESC:
+		l.index++
+
+		return afterCloseBraceDashEscape
+
+	case message.ST:
+		l.index++
+		l.emit(message.Command, l.text())
+
+		return text
+	}
+
+	return broken(l)
 }
 
 func afterCloseBraceDashEscape(l *T) action {
-	r, w := l.peek()
-
-	switch r {
+	switch l.peek() {
 	case eof:
 		return nil
 
 	case '\\':
-		l.accept(r, w)
+		l.index++
 		l.emit(message.Command, l.text())
+
+		return text
 	}
 
-	return text
+	return broken(l)
 }
 
 func afterEscape(l *T) action {
-	// println("afterEscape")
-	return on(l, '^', afterEscapeCaret)
+	switch l.peek() {
+	case eof:
+		return nil
+
+	case '^', '_', ']': // PM, APC, OSC.
+		l.index++
+
+		return afterIntroducer
+
+	case 'P': // DCS.
+		l.index++
+
+		return afterDCS
+	}
+
+	return text
 }
 
-func afterEscapeCaret(l *T) action {
-	return on(l, '-', afterEscapeCaretDash)
+// A DCS string may be a control message or a control message wrapped
+// to pass through tmux or screen. See message.Passthrough.
+func afterDCS(l *T) action {
+	switch b := l.peek(); {
+	case b == eof:
+		return nil
+
+	case b == 't':
+		return tmux
+
+	case b >= 0x90 && introducer(byte(b)):
+		return screen
+	}
+
+	return afterIntroducer
 }
 
-func afterEscapeCaretDash(l *T) action {
-	return on(l, '{', base64UntilCloseBrace)
+// Quoted text (an introducer followed by one or more carets and then a
+// dash) never matches and is scanned as text. See message.Quote. The
+// carets are kept with the introducer so that quoting is not split.
+func afterIntroducer(l *T) action {
+	return on(l, '-', afterIntroducerDash, carets)
 }
 
-func base64Char(r rune) bool {
-	set := "+/0123456789=ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
-	for _, v := range set {
-		if r == v {
-			return true
-		}
+func afterIntroducerDash(l *T) action {
+	return on(l, '{', base64UntilCloseBrace, text)
+}
+
+func base64Char(b byte) bool {
+	switch {
+	case 'A' <= b && b <= 'Z', 'a' <= b && b <= 'z', '0' <= b && b <= '9':
+		return true
 	}
 
-	return false
+	return b == '+' || b == '/' || b == '='
 }
 
 func base64UntilCloseBrace(l *T) action {
-	for {
-		r, w := l.peek()
+	for l.index < len(l.bytes) {
+		b := l.bytes[l.index]
 
-		switch r {
-		case eof:
-			return nil
-
-		case '}':
-			l.accept(r, w)
+		if b == '}' {
+			l.index++
 
 			return afterCloseBrace
+		}
 
-		default:
-			if !base64Char(r) {
-				return text
-			}
+		if !base64Char(b) {
+			return broken(l)
+		}
+
+		if l.index-l.first >= Limit {
+			return resync(l, &counts.Overflow)
+		}
+
+		l.index++
+	}
+
+	return nil
+}
+
+// broken recovers from a control message that ended unexpectedly.
+func broken(l *T) action {
+	return resync(l, &counts.Broken)
+}
 
-			l.accept(r, w)
+func carets(l *T) action {
+	for l.index < len(l.bytes) {
+		if l.bytes[l.index] != '^' {
+			return text
 		}
+
+		l.index++
 	}
+
+	return nil
 }
 
-func on(l *T, expected rune, perform action) action {
-	actual, width := l.peek()
+// index8 returns the index of the first ESC or 8-bit introducer in b, or
+// -1 if there isn't one.
+func index8(b []byte) int {
+	for i, c := range b {
+		if c == message.ESC || (c >= 0x90 && introducer(c)) {
+			return i
+		}
+	}
+
+	return -1
+}
 
-	switch actual {
+// introducer returns true if b starts a control string on its own.
+// These are the 8-bit (C1) forms of PM, APC, OSC, and DCS.
+func introducer(b byte) bool {
+	return b == 0x9e || b == 0x9f || b == 0x9d || b == 0x90
+}
+
+func on(l *T, expected int, perform, otherwise action) action {
+	switch l.peek() {
 	case eof:
 		return nil
 
 	case expected:
-		l.accept(actual, width)
+		l.index++
 
 		return perform
 
 	default:
-		return text
+		return otherwise
 	}
 }
 
-func text(l *T) action {
-	for {
-		r, w := l.peek()
+// resync emits everything scanned since the start of the current message
+// as text, counts why, and goes back to scanning text.
+func resync(l *T, counter *uint64) action {
+	atomic.AddUint64(counter, 1)
 
-		switch r {
-		case eof:
-			l.emit(message.Text, l.text())
+	l.emit(message.Text, l.text())
 
-			return nil
+	return text
+}
 
-		case message.ESC:
-			l.emit(message.Text, l.text())
-			l.accept(r, w)
+// screen unwraps a control message split across one or more DCS strings.
+func screen(l *T) action {
+	b := []byte{}
+
+	for i := l.index; ; {
+		n := bytes.IndexByte(l.bytes[i:], message.ESC)
+		if n == -1 {
+			return wait(l)
+		}
+
+		b = append(b, l.bytes[i:i+n]...)
+		i += n
+
+		switch rest := l.bytes[i:]; {
+		case len(rest) < len(st):
+			return wait(l)
+
+		case !bytes.HasPrefix(rest, st):
+			return broken(l)
+
+		case len(b) > 0 && b[len(b)-1] == message.ST:
+			return unwrapped(l, b, i+len(st))
 
-			return afterEscape
+		case len(rest) < len(joint):
+			return wait(l)
 
-		default: // Continue and get next character.
-			l.accept(r, w)
+		case !bytes.HasPrefix(rest, joint):
+			return broken(l)
 		}
+
+		i += len(joint)
+	}
+}
+
+func text(l *T) action {
+	n := -1
+	if l.c1 {
+		n = index8(l.bytes[l.index:])
+	} else {
+		n = bytes.IndexByte(l.bytes[l.index:], message.ESC)
+	}
+
+	if n == -1 {
+		l.index = len(l.bytes)
+		l.emit(message.Text, l.text())
+
+		return nil
+	}
+
+	l.index += n
+	l.emit(message.Text, l.text())
+
+	b := l.bytes[l.index]
+	l.index++
+
+	if b == message.ESC {
+		return afterEscape
 	}
+
+	return afterIntroducer
+}
+
+// unwrapped emits b, the contents of a tmux or screen passthrough string
+// that ends at end, as a control message if it is one. Anything else is
+// passed through as it was read.
+func unwrapped(l *T, b []byte, end int) action {
+	l.index = end
+
+	if l.index-l.first > Limit {
+		return resync(l, &counts.Overflow)
+	}
+
+	if message.IsFramed(b) {
+		l.item = message.Scanned(b, l.text())
+		l.skip()
+	} else {
+		l.emit(message.Text, l.text())
+	}
+
+	return text
 }
@@ -0,0 +1,278 @@
+// Released under an MIT license. See LICENSE.
+
+package lexer_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/michaelmacinnis/summit/pkg/comms"
+	"github.com/michaelmacinnis/summit/pkg/lexer"
+	"github.com/michaelmacinnis/summit/pkg/message"
+)
+
+// forged is text that looks like a control message in each 7-bit carrier.
+//
+//nolint:gochecknoglobals
+var forged = []string{
+	"\x1b^-{e30=}-\x1b\\",
+	"\x1b_-{e30=}-\x1b\\",
+	"\x1b]-{e30=}-\x1b\\",
+	"\x1bP-{e30=}-\x1b\\",
+}
+
+func TestQuoteRoundTrip(t *testing.T) {
+	for _, s := range append([]string{
+		"",
+		"plain text",
+		"Привет А-",
+		"x丝",
+		"\x1b[1mbold\x1b[0m",
+		"\x1b^^-already quoted",
+		"\x1b^^^-{quoted twice}-\x1b\\",
+		"\x1b^-",
+		"\x1b^",
+		"-{e30=}-",
+	}, forged...) {
+		q := message.Quote([]byte(s))
+
+		if u := message.Unquote(q); string(u) != s {
+			t.Errorf("Unquote(Quote(%q)) = %q", s, u)
+		}
+
+		for _, m := range scan(message.PM, q) {
+			if !m.Is(message.Text) {
+				t.Errorf("Quote(%q) scanned as %v", s, m)
+			}
+		}
+	}
+}
+
+func TestQuoteLeavesUTF8(t *testing.T) {
+	for _, s := range []string{"А-", "Привет А", "x丝-{", "ޞ-{e30=}-\x1b\\"} {
+		if q := message.Quote([]byte(s)); string(q) != s {
+			t.Errorf("Quote(%q) = %q", s, q)
+		}
+	}
+}
+
+func TestScanSplit(t *testing.T) {
+	ctl := string(message.Log{Text: "hello"}.Bytes())
+	tmux := string(message.Tmux.Wrap([]byte(ctl)))
+	screen := string(message.Screen.Wrap([]byte(ctl)))
+
+	for _, c := range []message.Carrier{message.PM, message.PM8} {
+		in := "before " + ctl + " Привет " + tmux + " x丝 " + screen + " after" +
+			string(c.Carry([]byte(ctl))) + "\x1bPtmux;\x1b\x1b]52;c;aGk=\a\x1b\\"
+
+		want := summary(scan(c, []byte(in)))
+
+		if n := strings.Count(want, "command"); n != 4 {
+			t.Fatalf("%v: scanned %d control messages, want 4: %s", c, n, want)
+		}
+
+		for i := 1; i < len(in); i++ {
+			if got := summary(scan(c, []byte(in[:i]), []byte(in[i:]))); got != want {
+				t.Errorf("%v: split at %d: got %s, want %s", c, i, got, want)
+			}
+		}
+
+		bs := [][]byte{}
+		for i := 0; i < len(in); i++ {
+			bs = append(bs, []byte{in[i]})
+		}
+
+		if got := summary(scan(c, bs...)); got != want {
+			t.Errorf("%v: a byte at a time: got %s, want %s", c, got, want)
+		}
+	}
+}
+
+func TestScanRecovery(t *testing.T) {
+	defer func(n int) { lexer.Limit = n }(lexer.Limit)
+
+	lexer.Limit = 200
+
+	ok := string(message.Log{Text: "ok"}.Bytes())
+	long := string(message.Log{Text: strings.Repeat("x", 300)}.Bytes())
+	wrapped := string(message.Screen.Wrap([]byte(long)))
+
+	tests := []struct {
+		name string
+		in   []string
+		want lexer.Counters
+	}{
+		{"overflow", []string{long}, lexer.Counters{Overflow: 1}},
+		{"overflow split", []string{long[:150], long[150:300], long[300:]}, lexer.Counters{Overflow: 1}},
+		{"tmux overflow", []string{string(message.Tmux.Wrap([]byte(long)))}, lexer.Counters{Overflow: 1}},
+		{"screen overflow split", []string{wrapped[:150], wrapped[150:300], wrapped[300:]}, lexer.Counters{Overflow: 1}},
+		{"broken", []string{"\x1b^-{e3!0=}-\x1b\\"}, lexer.Counters{Broken: 1}},
+		{"broken split", []string{"\x1b^-{e3", "0=}-\x1bx"}, lexer.Counters{Broken: 1}},
+		{"truncated", []string{"\x1b^-{e30="}, lexer.Counters{Truncated: 1}},
+	}
+
+	for _, test := range tests {
+		in := strings.Join(test.in, "")
+
+		// Unlike the bad message, a good one either side still scans.
+		bs := [][]byte{[]byte(ok + "before ")}
+		for _, s := range test.in {
+			bs = append(bs, []byte(s))
+		}
+
+		if test.want.Truncated == 0 {
+			bs = append(bs, []byte(" after"+ok))
+		}
+
+		before := lexer.Stats()
+		ms := scan(message.PM, bs...)
+		after := lexer.Stats()
+
+		got := lexer.Counters{
+			Broken:    after.Broken - before.Broken,
+			Overflow:  after.Overflow - before.Overflow,
+			Truncated: after.Truncated - before.Truncated,
+		}
+		if got != test.want {
+			t.Errorf("%s: counted %+v, want %+v", test.name, got, test.want)
+		}
+
+		want := "(command: log &{Text:ok}) | text before " + in
+		if test.want.Truncated == 0 {
+			want += " after | (command: log &{Text:ok})"
+		}
+
+		if got := summary(ms); got != want {
+			t.Errorf("%s: got %s, want %s", test.name, got, want)
+		}
+	}
+}
+
+func TestScanText(t *testing.T) {
+	for _, s := range []string{"Привет А", "x丝", "\x9e-{e30=}-\x9c"} {
+		got := summary(scan(message.PM, []byte(s)))
+		if want := "text " + s; got != want {
+			t.Errorf("scanned %q as %q", s, got)
+		}
+	}
+}
+
+func TestScanTransparent(t *testing.T) {
+	for _, s := range append([]string{
+		"\x1bPtmux;\x1b\x1b]52;c;aGk=\a\x1b\\",
+		"\x1bP\x90q#0;2;0;0;0\x1b\\",
+		"\x1b]0;title\a",
+	}, forged...) {
+		got := []byte{}
+		for _, m := range scan(message.PM, []byte(s)) {
+			got = append(got, m.Original()...)
+		}
+
+		if string(got) != s {
+			t.Errorf("scanned %q as %q", s, got)
+		}
+	}
+}
+
+func BenchmarkChunk(b *testing.B) {
+	benchmarkChunk(b, message.PM, text(1<<20))
+}
+
+func BenchmarkChunk8Bit(b *testing.B) {
+	benchmarkChunk(b, message.PM8, text(1<<20))
+}
+
+func BenchmarkChunkMessages(b *testing.B) {
+	ctl := message.Log{Text: "progress"}.Bytes()
+
+	in := []byte{}
+	for len(in) < 1<<20 {
+		in = append(in, "compiling pkg/lexer\r\n"...)
+		in = append(in, ctl...)
+	}
+
+	benchmarkChunk(b, message.PM, in)
+}
+
+func BenchmarkScan(b *testing.B) {
+	in := text(1 << 20)
+
+	b.SetBytes(int64(len(in)))
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		l := lexer.New(message.PM)
+
+		for n := 0; n < len(in); n += 65536 {
+			l.Scan(in[n : n+65536])
+			for m := l.Chunk(); m != nil; m = l.Chunk() {
+			}
+		}
+	}
+}
+
+func benchmarkChunk(b *testing.B, c message.Carrier, in []byte) {
+	b.Helper()
+
+	b.SetBytes(int64(len(in)))
+	b.ReportAllocs()
+
+	for i := 0; i < b.N; i++ {
+		for range comms.Chunk(bytes.NewReader(in), c) {
+		}
+	}
+}
+
+// scan returns the messages scanned from bs, as if read in that order.
+func scan(c message.Carrier, bs ...[]byte) []*message.T {
+	l := lexer.New(c)
+	ms := []*message.T{}
+
+	for _, b := range bs {
+		l.Scan(append([]byte{}, b...))
+		for m := l.Chunk(); m != nil; m = l.Chunk() {
+			ms = append(ms, m)
+		}
+	}
+
+	if m := l.Flush(); m != nil {
+		ms = append(ms, m)
+	}
+
+	return ms
+}
+
+// summary joins consecutive text and describes each control message.
+func summary(ms []*message.T) string {
+	parts := []string{}
+	text := ""
+
+	for _, m := range ms {
+		if m.Is(message.Text) {
+			text += string(m.Bytes())
+
+			continue
+		}
+
+		if text != "" {
+			parts = append(parts, "text "+text)
+			text = ""
+		}
+
+		parts = append(parts, m.String())
+	}
+
+	if text != "" {
+		parts = append(parts, "text "+text)
+	}
+
+	return strings.Join(parts, " | ")
+}
+
+// text returns n bytes of output like that of a build.
+func text(n int) []byte {
+	line := []byte("ok  \tgithub.com/michaelmacinnis/summit/pkg/lexer\t0.012s Привет\r\n")
+
+	return bytes.Repeat(line, n/len(line)+1)[:n]
+}
@@ -0,0 +1,106 @@
+// Released under an MIT license. See LICENSE.
+
+package message
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// Key is the secret shared by the two ends of a single hop. Control
+// messages written to a hop are signed with its key and control messages
+// read from a hop are only acted on if they were signed with the same key.
+// This prevents a program from forging control messages by writing them
+// to its terminal.
+type Key []byte
+
+const tagsz = sha256.Size
+
+// NewKey creates a new random key.
+func NewKey() Key {
+	k := make(Key, tagsz)
+
+	if _, err := rand.Read(k); err != nil {
+		panic(err.Error())
+	}
+
+	return k
+}
+
+// ParseKey converts the string representation of a key back to a key.
+// An empty or invalid string results in a nil key.
+func ParseKey(s string) Key {
+	k, err := hex.DecodeString(s)
+	if err != nil || len(k) == 0 {
+		return nil
+	}
+
+	return k
+}
+
+// Sign returns b authenticated with k, if b is a control message.
+// Anything else is returned unchanged.
+func (k Key) Sign(b []byte) []byte {
+	if k == nil {
+		return b
+	}
+
+	p := payload(b)
+	if p == nil {
+		return b
+	}
+
+	k.sign(p)
+
+	return frame(p)
+}
+
+// MarshalText returns the string representation of a key as text.
+func (k Key) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// String returns the string representation of a key.
+func (k Key) String() string {
+	return hex.EncodeToString(k)
+}
+
+// Verify returns true if m is not a control message or if m was signed
+// with k. A nil key (an unauthenticated hop) verifies everything.
+func (k Key) Verify(m *message) bool {
+	if k == nil || !m.Is(Command) {
+		return true
+	}
+
+	p := m.contents()
+	if p == nil {
+		return false
+	}
+
+	return hmac.Equal(p[:tagsz], k.tag(p[tagsz:]))
+}
+
+// UnmarshalText converts the string representation of a key back to a key.
+func (k *Key) UnmarshalText(b []byte) error {
+	*k = ParseKey(string(b))
+
+	return nil
+}
+
+// sign replaces the authentication tag at the start of p, a tag followed
+// by JSON, with one made with k.
+func (k Key) sign(p []byte) {
+	if k != nil {
+		copy(p[:tagsz], k.tag(p[tagsz:]))
+	}
+}
+
+func (k Key) tag(j []byte) []byte {
+	h := hmac.New(sha256.New, k)
+
+	h.Write(j)
+
+	return h.Sum(nil)
+}
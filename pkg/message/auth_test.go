@@ -0,0 +1,85 @@
+// Released under an MIT license. See LICENSE.
+
+package message_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/michaelmacinnis/summit/pkg/message"
+)
+
+func TestVerify(t *testing.T) {
+	k := message.NewKey()
+
+	signed := k.Sign(message.Credit{N: 1}.Bytes())
+
+	if !k.Verify(message.Raw(signed)) {
+		t.Error("message signed with the key not verified")
+	}
+
+	if message.NewKey().Verify(message.Raw(signed)) {
+		t.Error("message signed with another key verified")
+	}
+
+	if k.Verify(message.Raw(message.Credit{N: 1}.Bytes())) {
+		t.Error("unsigned message verified")
+	}
+
+	if !k.Verify(decoded(body(signed))) {
+		t.Error("message signed with the key not verified in binary framing")
+	}
+
+	// The same tag on different JSON.
+	tag := body(signed)[:32]
+	forged := append(append([]byte{}, tag...), `{"cmd":"credit","credit":9}`...)
+
+	if k.Verify(decoded(forged)) {
+		t.Error("forged message verified")
+	}
+
+	// Text isn't signed and a nil key verifies everything.
+	if !k.Verify(message.New(message.Text, []byte("text"))) {
+		t.Error("text not verified")
+	}
+
+	if !message.Key(nil).Verify(message.Raw(message.Credit{N: 1}.Bytes())) {
+		t.Error("nil key didn't verify")
+	}
+
+	if s := k.Sign([]byte("text")); !bytes.Equal(s, []byte("text")) {
+		t.Errorf("text changed by signing: %q", s)
+	}
+}
+
+func TestParseKey(t *testing.T) {
+	k := message.NewKey()
+
+	if got := message.ParseKey(k.String()); !bytes.Equal(got, k) {
+		t.Errorf("got %v, want %v", got, k)
+	}
+
+	for _, s := range []string{"", "not hex", "abc"} {
+		if got := message.ParseKey(s); got != nil {
+			t.Errorf("%q: got %v, want nil", s, got)
+		}
+	}
+}
+
+// body returns the authentication tag and JSON of the control message b.
+func body(b []byte) []byte {
+	return message.Encode(b, nil, "")[5:]
+}
+
+// decoded returns a control message, with the authentication tag and
+// JSON p, as read in binary framing.
+func decoded(p []byte) *message.T {
+	e := []byte{1, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(e[1:], uint32(len(p)))
+
+	d := &message.Decoder{}
+	d.Scan(append(e, p...))
+
+	return d.Chunk()
+}
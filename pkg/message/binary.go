@@ -0,0 +1,102 @@
+// Released under an MIT license. See LICENSE.
+
+package message
+
+import (
+	"encoding/binary"
+)
+
+// Binary framing is used on hops between summit processes that are never
+// terminals. Each message is a class byte and a big-endian length followed
+// by the message's text or, for control messages, its authentication tag
+// and JSON. There is no base64 encoding and no PM/ST.
+//
+// A message may also be addressed to a terminal. Addressed messages have
+// the high bit of their class byte set and start with the length of the
+// terminal's ID, as a single byte, followed by the ID.
+
+// Decoder extracts messages from a stream in binary framing.
+type Decoder struct {
+	buffer []byte
+}
+
+const (
+	binaryText byte = iota
+	binaryCommand
+
+	addressed = 0x80
+	hdrsz     = 5
+	maxaddr   = 255
+)
+
+// Encode converts b, text or a control message, to binary framing.
+// A control message is signed with k as it is converted. If address is
+// not empty the message is addressed to that terminal.
+func Encode(b []byte, k Key, address string) []byte {
+	cls, p := binaryText, b
+	if q := payload(b); q != nil {
+		cls, p = binaryCommand, q
+
+		k.sign(p)
+	}
+
+	a := []byte(address)
+	if len(a) > maxaddr {
+		a = nil
+	}
+
+	n := len(p)
+	if len(a) > 0 {
+		cls |= addressed
+		n += 1 + len(a)
+	}
+
+	e := make([]byte, hdrsz, hdrsz+n)
+
+	e[0] = cls
+	binary.BigEndian.PutUint32(e[1:hdrsz], uint32(n))
+
+	if len(a) > 0 {
+		e = append(e, byte(len(a)))
+		e = append(e, a...)
+	}
+
+	return append(e, p...)
+}
+
+// Chunk returns the next decoded message, or nil if no message is available.
+func (d *Decoder) Chunk() *message {
+	if len(d.buffer) < hdrsz {
+		return nil
+	}
+
+	n := hdrsz + int(binary.BigEndian.Uint32(d.buffer[1:hdrsz]))
+	if len(d.buffer) < n {
+		return nil
+	}
+
+	cls, p := d.buffer[0], d.buffer[hdrsz:n]
+
+	d.buffer = d.buffer[n:]
+
+	address := ""
+	if cls&addressed != 0 && len(p) > 0 && int(p[0]) < len(p) {
+		address, p = string(p[1:1+p[0]]), p[1+p[0]:]
+	}
+
+	// The contents of a control message are kept as they are. It is
+	// only framed if passed on to a hop that isn't in binary framing.
+	m := New(Text, p)
+	if cls&^addressed == binaryCommand && len(p) >= tagsz {
+		m = &message{body: p, cls: Command}
+	}
+
+	m.address = address
+
+	return m
+}
+
+// Scan passes bytes to the decoder.
+func (d *Decoder) Scan(b []byte) {
+	d.buffer = append(d.buffer, b...)
+}
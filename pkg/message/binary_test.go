@@ -0,0 +1,99 @@
+// Released under an MIT license. See LICENSE.
+
+package message_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/michaelmacinnis/summit/pkg/message"
+)
+
+func TestEncode(t *testing.T) {
+	k := message.NewKey()
+
+	tests := []struct {
+		name    string
+		b       []byte
+		address string
+	}{
+		{"text", []byte("text"), ""},
+		{"empty text", []byte{}, ""},
+		{"control", message.Pty{ID: "3"}.Bytes(), ""},
+		{"addressed text", []byte("text"), "12"},
+		{"addressed control", message.Credit{N: 32}.Bytes(), "7"},
+		{"long address", []byte("text"), strings.Repeat("9", 256)},
+	}
+
+	for _, test := range tests {
+		d := &message.Decoder{}
+		d.Scan(message.Encode(test.b, k, test.address))
+
+		m := d.Chunk()
+		if m == nil {
+			t.Fatalf("%s: no message", test.name)
+		}
+
+		if d.Chunk() != nil {
+			t.Errorf("%s: more than one message", test.name)
+		}
+
+		want := test.address
+		if len(want) > 255 {
+			want = ""
+		}
+
+		if m.Address() != want {
+			t.Errorf("%s: got address %q, want %q", test.name, m.Address(), want)
+		}
+
+		if !k.Verify(m) {
+			t.Errorf("%s: not signed", test.name)
+		}
+
+		if got, want := body(m.Bytes()), body(k.Sign(test.b)); !bytes.Equal(got, want) {
+			t.Errorf("%s: got %q, want %q", test.name, got, want)
+		}
+	}
+}
+
+func TestDecoderSplit(t *testing.T) {
+	var stream []byte
+
+	want := [][]byte{
+		[]byte("first"),
+		message.Status{Status: 3}.Bytes(),
+		[]byte("last"),
+	}
+
+	for _, b := range want {
+		stream = append(stream, message.Encode(b, nil, "4")...)
+	}
+
+	// A byte at a time, messages only come out once they are whole.
+	d := &message.Decoder{}
+	got := [][]byte{}
+
+	for i := range stream {
+		d.Scan(stream[i : i+1])
+
+		for m := d.Chunk(); m != nil; m = d.Chunk() {
+			if m.Address() != "4" {
+				t.Errorf("got address %q", m.Address())
+			}
+
+			got = append(got, m.Bytes())
+		}
+	}
+
+	if len(got) != len(want) {
+		t.Fatalf("got %d messages, want %d", len(got), len(want))
+	}
+
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Errorf("message %d: got %q, want %q", i, got[i], want[i])
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Released under an MIT license. See LICENSE.
+
+package message
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Carrier is the kind of control string used to delimit control messages
+// on a hop. Privacy messages (PM) are used by default but some terminals,
+// multiplexers, and serial consoles strip PM while passing APC, OSC, or
+// DCS. Each carrier also has an 8-bit (C1) form. Messages are read in any
+// 7-bit carrier and, on a hop that uses one, in any 8-bit carrier. The
+// 8-bit introducers are common in UTF-8 text so, once read, a control
+// message is always in its 7-bit form.
+type Carrier int
+
+// Carriers.
+const (
+	PM   Carrier = iota // ESC ^ ... ESC \
+	APC                 // ESC _ ... ESC \
+	OSC                 // ESC ] ... ESC \
+	DCS                 // ESC P ... ESC \
+	PM8                 // 0x9e ... 0x9c
+	APC8                // 0x9f ... 0x9c
+	OSC8                // 0x9d ... 0x9c
+	DCS8                // 0x90 ... 0x9c
+)
+
+// ST is the 8-bit (C1) string terminator.
+const ST = 0x9c
+
+// ErrCarrier is returned by ParseCarrier for an unknown carrier.
+var ErrCarrier = errors.New("unknown carrier")
+
+// ParseCarrier converts the name of a carrier ("pm", "apc", "osc", "dcs",
+// or the 8-bit forms "pm8", "apc8", "osc8", "dcs8") to a carrier.
+func ParseCarrier(s string) (Carrier, error) {
+	for c, v := range carriers {
+		if v.name == s {
+			return Carrier(c), nil
+		}
+	}
+
+	return PM, fmt.Errorf("%w: %q", ErrCarrier, s)
+}
+
+// IsFramed returns true if b, in its entirety, is a control message in
+// any carrier.
+func IsFramed(b []byte) bool {
+	_, enc, n := match(b, DCS8)
+
+	return len(enc) > 0 && n == len(b)
+}
+
+// Carry returns b framed with carrier c, if b is a control message.
+// Anything else is returned unchanged.
+func (c Carrier) Carry(b []byte) []byte {
+	f, enc := split(b)
+	if enc == nil || f == c {
+		return b
+	}
+
+	return c.frame(enc)
+}
+
+// Is8Bit returns true if c is one of the 8-bit (C1) carriers.
+func (c Carrier) Is8Bit() bool {
+	return c >= PM8
+}
+
+// String returns the name of the carrier.
+func (c Carrier) String() string {
+	return carriers[c].name
+}
+
+// eightBit returns the 8-bit form of c.
+func (c Carrier) eightBit() Carrier {
+	if c < PM8 {
+		return c + PM8 - PM
+	}
+
+	return c
+}
+
+// sevenBit returns the 7-bit form of c.
+func (c Carrier) sevenBit() Carrier {
+	if c >= PM8 {
+		return c - PM8 + PM
+	}
+
+	return c
+}
+
+func (c Carrier) frame(enc []byte) []byte {
+	v := carriers[c]
+
+	s := make([]byte, 0, len(v.introducer)+len(enc)+len(v.terminator)+len(lbrace)+len(rbrace))
+
+	s = append(s, v.introducer...)
+	s = append(s, lbrace...)
+	s = append(s, enc...)
+	s = append(s, rbrace...)
+
+	return append(s, v.terminator...)
+}
+
+// introducer returns the length of the 7-bit control string introducer
+// at the start of b, or 0 if b does not start with one.
+func introducer(b []byte) int {
+	for _, c := range carriers[:PM8] {
+		if bytes.HasPrefix(b, c.introducer) {
+			return len(c.introducer)
+		}
+	}
+
+	return 0
+}
+
+// match returns the carrier, base 64 encoded contents, and length of the
+// control message at the start of b, in any carrier up to last, or nil
+// contents if b does not start with one. Either terminator is accepted.
+func match(b []byte, last Carrier) (Carrier, []byte, int) {
+	for c, v := range carriers[:last+1] {
+		n := len(v.introducer)
+		if !bytes.HasPrefix(b, v.introducer) || !bytes.HasPrefix(b[n:], lbrace) {
+			continue
+		}
+
+		n += len(lbrace)
+
+		e := bytes.Index(b[n:], rbrace)
+		if e == -1 {
+			return PM, nil, 0
+		}
+
+		enc := b[n : n+e]
+		n += e + len(rbrace)
+
+		switch t := b[n:]; {
+		case bytes.HasPrefix(t, carriers[PM].terminator):
+			n += len(carriers[PM].terminator)
+		case bytes.HasPrefix(t, carriers[PM8].terminator):
+			n += len(carriers[PM8].terminator)
+		default:
+			return PM, nil, 0
+		}
+
+		return Carrier(c), enc, n
+	}
+
+	return PM, nil, 0
+}
+
+// split returns the carrier and base 64 encoded contents of b, or nil
+// contents if b is not a control message in a 7-bit carrier.
+func split(b []byte) (Carrier, []byte) {
+	c, enc, _ := match(b, DCS)
+
+	return c, enc
+}
+
+//nolint:gochecknoglobals
+var (
+	carriers = [...]struct {
+		name       string
+		introducer []byte
+		terminator []byte
+	}{
+		PM:   {"pm", []byte{ESC, '^'}, []byte{ESC, '\\'}},
+		APC:  {"apc", []byte{ESC, '_'}, []byte{ESC, '\\'}},
+		OSC:  {"osc", []byte{ESC, ']'}, []byte{ESC, '\\'}},
+		DCS:  {"dcs", []byte{ESC, 'P'}, []byte{ESC, '\\'}},
+		PM8:  {"pm8", []byte{0x9e}, []byte{ST}},
+		APC8: {"apc8", []byte{0x9f}, []byte{ST}},
+		OSC8: {"osc8", []byte{0x9d}, []byte{ST}},
+		DCS8: {"dcs8", []byte{0x90}, []byte{ST}},
+	}
+
+	// The base 64 encoded contents of a control message are enclosed
+	// in "-{" and "}-".
+	lbrace = []byte{'-', '{'}
+	rbrace = []byte{'}', '-'}
+)
@@ -0,0 +1,369 @@
+// Released under an MIT license. See LICENSE.
+
+package message
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/michaelmacinnis/summit/pkg/terminal"
+)
+
+// Control is implemented by each type of control message.
+type Control interface {
+	// Bytes returns the serialized control message.
+	Bytes() []byte
+
+	command() string
+}
+
+// Ack acknowledges the Run with the same ID.
+type Ack struct {
+	ID string `json:"ack"`
+}
+
+// Attach requests that a detached session be attached to the terminal
+// that sent it.
+type Attach struct{}
+
+// Attached reports that a session has been attached to a terminal.
+type Attached struct{}
+
+// Binary tells the peer that everything after this message is in
+// binary framing. See binary.go.
+type Binary struct{}
+
+// Capture requests the text on the screen of a session.
+type Capture struct{}
+
+// Captured is the text on the screen of a session.
+type Captured struct {
+	Text string `json:"captured"`
+}
+
+// Channel stands in for a route. The first time a route is sent on a hop
+// it is followed by a channel ID. After that the ID alone is sent.
+type Channel struct {
+	ID string `json:"ch"`
+}
+
+// Credit lets a session send N more messages to its terminal.
+// See Window.
+type Credit struct {
+	N int `json:"credit"`
+}
+
+// Error reports a failure to the peer. ID is set when the failure is
+// the reply to a Run.
+type Error struct {
+	Reason string `json:"error"`
+	ID     string `json:"id,omitempty"`
+}
+
+// Hangup tells a mux that the terminal for a session has gone away.
+type Hangup struct{}
+
+// Hello announces the protocol spoken by the sender. See protocol.go.
+type Hello struct {
+	Capabilities []string `json:"caps"`
+	Version      int      `json:"version"`
+}
+
+// List requests the detached sessions of a mux.
+type List struct{}
+
+// Log is debugging output for the server to print.
+type Log struct {
+	Text string `json:"log"`
+}
+
+// Pty is part of a route. It identifies a session within a mux.
+type Pty struct {
+	ID string `json:"pty"`
+}
+
+// Resolve asks the server for the routing path of the mux named Name.
+// The server replies with Resolved or an Error.
+type Resolve struct {
+	Name string `json:"resolve"`
+}
+
+// Resolved is the routing path of a named mux.
+type Resolved struct {
+	Path string `json:"resolved"`
+}
+
+// Run requests a new session running Args with the environment Env.
+// A requester that sets ID is sent an Ack, or an Error, with the same
+// ID. If it also sets Wait, it is sent the session's Status, again with
+// the same ID, when the session ends.
+type Run struct {
+	Args []string `json:"run"`
+	Env  []string `json:"env,omitempty"`
+	ID   string   `json:"id,omitempty"`
+	Wait bool     `json:"wait,omitempty"`
+}
+
+// Secret is the key for the hop it is sent over. See auth.go.
+type Secret struct {
+	Key Key `json:"secret"`
+}
+
+// Session describes a detached session.
+type Session struct {
+	ID   string   `json:"id"`
+	Args []string `json:"args"`
+}
+
+// Sessions lists the detached sessions of a mux.
+type Sessions struct {
+	Detached []Session `json:"sessions"`
+}
+
+// Share requests that a session also be shown on the terminal that
+// sent it. Input from a read-only terminal is dropped.
+type Share struct {
+	ReadOnly bool `json:"readonly,omitempty"`
+}
+
+// Started reports that a new session has started. Name is the name of
+// the mux that started it.
+type Started struct {
+	Name string `json:"name,omitempty"`
+}
+
+// Status reports that a session has ended and its exit status. ID is
+// set when the status is the reply to a Run that waits for it.
+type Status struct {
+	Status int    `json:"status"`
+	ID     string `json:"id,omitempty"`
+}
+
+// Term is the start of a route. It identifies a terminal on the server.
+type Term struct {
+	ID string `json:"term"`
+}
+
+// TerminalSize reports the size of a terminal.
+type TerminalSize struct {
+	Size *terminal.Size `json:"ts"`
+}
+
+// Errors returned when decoding control messages.
+var (
+	ErrMalformed = errors.New("malformed control message")
+	ErrUnknown   = errors.New("unknown control message")
+)
+
+func (c Ack) Bytes() []byte          { return serialize(c) }
+func (c Attach) Bytes() []byte       { return serialize(c) }
+func (c Attached) Bytes() []byte     { return serialize(c) }
+func (c Binary) Bytes() []byte       { return serialize(c) }
+func (c Capture) Bytes() []byte      { return serialize(c) }
+func (c Captured) Bytes() []byte     { return serialize(c) }
+func (c Channel) Bytes() []byte      { return serialize(c) }
+func (c Credit) Bytes() []byte       { return serialize(c) }
+func (c Error) Bytes() []byte        { return serialize(c) }
+func (c Hangup) Bytes() []byte       { return serialize(c) }
+func (c Hello) Bytes() []byte        { return serialize(c) }
+func (c List) Bytes() []byte         { return serialize(c) }
+func (c Log) Bytes() []byte          { return serialize(c) }
+func (c Pty) Bytes() []byte          { return serialize(c) }
+func (c Resolve) Bytes() []byte      { return serialize(c) }
+func (c Resolved) Bytes() []byte     { return serialize(c) }
+func (c Run) Bytes() []byte          { return serialize(c) }
+func (c Secret) Bytes() []byte       { return serialize(c) }
+func (c Sessions) Bytes() []byte     { return serialize(c) }
+func (c Share) Bytes() []byte        { return serialize(c) }
+func (c Started) Bytes() []byte      { return serialize(c) }
+func (c Status) Bytes() []byte       { return serialize(c) }
+func (c Term) Bytes() []byte         { return serialize(c) }
+func (c TerminalSize) Bytes() []byte { return serialize(c) }
+
+func (Ack) command() string          { return "ack" }
+func (Attach) command() string       { return "attach" }
+func (Attached) command() string     { return "attached" }
+func (Binary) command() string       { return "binary" }
+func (Capture) command() string      { return "capture" }
+func (Captured) command() string     { return "captured" }
+func (Channel) command() string      { return "ch" }
+func (Credit) command() string       { return "credit" }
+func (Error) command() string        { return "error" }
+func (Hangup) command() string       { return "hangup" }
+func (Hello) command() string        { return "hello" }
+func (List) command() string         { return "list" }
+func (Log) command() string          { return "log" }
+func (Pty) command() string          { return "pty" }
+func (Resolve) command() string      { return "resolve" }
+func (Resolved) command() string     { return "resolved" }
+func (Run) command() string          { return "run" }
+func (Secret) command() string       { return "secret" }
+func (Sessions) command() string     { return "sessions" }
+func (Share) command() string        { return "share" }
+func (Started) command() string      { return "started" }
+func (Status) command() string       { return "status" }
+func (Term) command() string         { return "term" }
+func (TerminalSize) command() string { return "ts" }
+
+// Supports returns true if the sender of h listed the capability c.
+func (h *Hello) Supports(c string) bool {
+	for _, s := range h.Capabilities {
+		if s == c {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NewHello returns a hello for this build.
+func NewHello() Hello {
+	return Hello{Capabilities: Capabilities, Version: Version}
+}
+
+//nolint:gochecknoglobals
+var commands = map[string]func() Control{
+	"ack":      func() Control { return &Ack{} },
+	"attach":   func() Control { return &Attach{} },
+	"attached": func() Control { return &Attached{} },
+	"binary":   func() Control { return &Binary{} },
+	"capture":  func() Control { return &Capture{} },
+	"captured": func() Control { return &Captured{} },
+	"ch":       func() Control { return &Channel{} },
+	"credit":   func() Control { return &Credit{} },
+	"error":    func() Control { return &Error{} },
+	"hangup":   func() Control { return &Hangup{} },
+	"hello":    func() Control { return &Hello{} },
+	"list":     func() Control { return &List{} },
+	"log":      func() Control { return &Log{} },
+	"pty":      func() Control { return &Pty{} },
+	"resolve":  func() Control { return &Resolve{} },
+	"resolved": func() Control { return &Resolved{} },
+	"run":      func() Control { return &Run{} },
+	"secret":   func() Control { return &Secret{} },
+	"sessions": func() Control { return &Sessions{} },
+	"share":    func() Control { return &Share{} },
+	"started":  func() Control { return &Started{} },
+	"status":   func() Control { return &Status{} },
+	"term":     func() Control { return &Term{} },
+	"ts":       func() Control { return &TerminalSize{} },
+}
+
+// decode converts JSON to the matching control message type. Unknown
+// commands, missing fields and values of the wrong type are errors.
+func decode(j []byte) (Control, error) {
+	kv := map[string]json.RawMessage{}
+	if err := json.Unmarshal(j, &kv); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrMalformed, err.Error())
+	}
+
+	cmd := ""
+	if err := json.Unmarshal(kv["cmd"], &cmd); err != nil {
+		return nil, fmt.Errorf("%w: no command", ErrMalformed)
+	}
+
+	f, ok := commands[cmd]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknown, cmd)
+	}
+
+	c := f()
+
+	if err := json.Unmarshal(j, c); err != nil {
+		return nil, fmt.Errorf("%w: %s: %s", ErrMalformed, cmd, err.Error())
+	}
+
+	if k := missing(c, kv); k != "" {
+		return nil, fmt.Errorf("%w: %s: missing %q", ErrMalformed, cmd, k)
+	}
+
+	if s := invalid(c); s != "" {
+		return nil, fmt.Errorf("%w: %s: %s", ErrMalformed, cmd, s)
+	}
+
+	return c, nil
+}
+
+// invalid checks values that JSON alone can't and describes any problem.
+func invalid(c Control) string {
+	switch c := c.(type) {
+	case *Ack:
+		if c.ID == "" {
+			return "no request id"
+		}
+
+	case *Channel:
+		if c.ID == "" {
+			return "no channel id"
+		}
+
+	case *Credit:
+		if c.N <= 0 {
+			return "invalid credit"
+		}
+
+	case *Hello:
+		if c.Version <= 0 {
+			return "invalid version"
+		}
+
+	case *Resolve:
+		if c.Name == "" {
+			return "no name"
+		}
+
+	case *Run:
+		if len(c.Args) == 0 {
+			return "no command to run"
+		}
+
+	case *Secret:
+		if len(c.Key) == 0 {
+			return "no key"
+		}
+
+	case *TerminalSize:
+		if c.Size == nil {
+			return "no size"
+		}
+	}
+
+	return ""
+}
+
+// missing returns the first required field of c not present in kv.
+// Fields tagged omitempty are optional.
+func missing(c Control, kv map[string]json.RawMessage) string {
+	t := reflect.TypeOf(c).Elem()
+
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("json"), ",")
+		if len(tag) > 1 && tag[1] == "omitempty" {
+			continue
+		}
+
+		if _, ok := kv[tag[0]]; !ok {
+			return tag[0]
+		}
+	}
+
+	return ""
+}
+
+func serialize(c Control) []byte {
+	j, err := json.Marshal(c)
+	if err != nil {
+		return nil
+	}
+
+	// Insert the command name at the start of the JSON object.
+	b := []byte(`{"cmd":"` + c.command() + `"`)
+	if len(j) > 2 {
+		b = append(b, ',')
+	}
+
+	return Serialize(append(b, j[1:]...))
+}
@@ -0,0 +1,71 @@
+// Released under an MIT license. See LICENSE.
+
+package message_test
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/michaelmacinnis/summit/pkg/message"
+	"github.com/michaelmacinnis/summit/pkg/terminal"
+)
+
+func TestDeserialize(t *testing.T) {
+	controls := []message.Control{
+		&message.Ack{ID: "1"},
+		&message.Attach{},
+		&message.Credit{N: 32},
+		&message.Error{Reason: "failed", ID: "2"},
+		&message.Hello{Capabilities: []string{"auth"}, Version: message.Version},
+		&message.Run{Args: []string{"sh", "-c", "exit 3"}, Env: []string{"A=1"}, ID: "3", Wait: true},
+		&message.Sessions{Detached: []message.Session{{ID: "1", Args: []string{"sh"}}}},
+		&message.Status{Status: 3},
+		&message.TerminalSize{Size: &terminal.Size{Rows: 24, Cols: 80}},
+	}
+
+	for _, want := range controls {
+		got, err := message.Deserialize(want.Bytes())
+		if err != nil {
+			t.Errorf("%T: %v", want, err)
+		} else if !reflect.DeepEqual(got, want) {
+			t.Errorf("got %+v, want %+v", got, want)
+		}
+	}
+}
+
+func TestDeserializeErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		json string
+		err  error
+	}{
+		{"not json", `credit`, message.ErrMalformed},
+		{"not an object", `["credit"]`, message.ErrMalformed},
+		{"no command", `{"credit":1}`, message.ErrMalformed},
+		{"command not a string", `{"cmd":1}`, message.ErrMalformed},
+		{"unknown command", `{"cmd":"launch"}`, message.ErrUnknown},
+		{"missing field", `{"cmd":"credit"}`, message.ErrMalformed},
+		{"missing status", `{"cmd":"status"}`, message.ErrMalformed},
+		{"wrong type", `{"cmd":"credit","credit":"lots"}`, message.ErrMalformed},
+		{"wrong type of list", `{"cmd":"run","run":"sh"}`, message.ErrMalformed},
+		{"invalid value", `{"cmd":"credit","credit":-1}`, message.ErrMalformed},
+		{"empty value", `{"cmd":"run","run":[]}`, message.ErrMalformed},
+		{"null size", `{"cmd":"ts","ts":null}`, message.ErrMalformed},
+		{"optional field", `{"cmd":"status","status":0}`, nil},
+	}
+
+	for _, test := range tests {
+		_, err := message.Deserialize(message.Serialize([]byte(test.json)))
+		if !errors.Is(err, test.err) {
+			t.Errorf("%s: got %v, want %v", test.name, err, test.err)
+		}
+	}
+
+	// Anything that isn't a control message.
+	for _, b := range []string{"text", "\x1b^-not base64-\x1b\\", "\x1b^--\x1b\\"} {
+		if _, err := message.Deserialize([]byte(b)); !errors.Is(err, message.ErrMalformed) {
+			t.Errorf("%q: got %v, want %v", b, err, message.ErrMalformed)
+		}
+	}
+}
@@ -5,7 +5,7 @@ package message
 import (
 	"bytes"
 	"encoding/base64"
-	"encoding/json"
+	"fmt"
 )
 
 const ESC = 0x1b
@@ -16,61 +16,109 @@ var (
 	EOT  = []byte{4}
 )
 
-func Deserialize(b []byte) map[string]interface{} {
-	if !bytes.HasPrefix(b, pm) {
-		return nil
+// Deserialize decodes the control message in b.
+func Deserialize(b []byte) (Control, error) {
+	p := payload(b)
+	if p == nil {
+		return nil, errFraming
 	}
 
-	n := bytes.Index(b, st)
-	if n == -1 {
+	return decode(p[tagsz:])
+}
+
+// Quote escapes text so that it can't be mistaken for a control message.
+// Every control string introducer (in any 7-bit carrier) that is followed
+// by zero or more carets and then a dash has another caret added. The
+// 8-bit introducers are left alone. They are common in UTF-8 text and a
+// control message is never in an 8-bit carrier once read.
+func Quote(b []byte) []byte {
+	return requote(b, 1)
+}
+
+// Serialize frames j, a JSON object, as a control message.
+func Serialize(j []byte) []byte {
+	// Messages are unauthenticated until signed by a writer.
+	return frame(append(make([]byte, tagsz), j...))
+}
+
+// Unquote reverses Quote.
+func Unquote(b []byte) []byte {
+	return requote(b, -1)
+}
+
+// frame wraps p, an authentication tag followed by JSON, in PM/ST.
+// Control messages have the form: ESC^-{Base 64 encoded JSON}-ESC\.
+// The JSON is preceded by an authentication tag. See auth.go. Other
+// carriers replace ESC^ and ESC\. See carrier.go.
+func frame(p []byte) []byte {
+	enc := make([]byte, b64.EncodedLen(len(p)))
+
+	b64.Encode(enc, p)
+
+	return PM.frame(enc)
+}
+
+// payload returns the decoded contents of a control message or nil
+// if b is not a control message.
+func payload(b []byte) []byte {
+	_, enc := split(b)
+	if enc == nil {
 		return nil
 	}
 
-	d := json.NewDecoder(base64.NewDecoder(b64, bytes.NewBuffer(b[lpm:n])))
-
-	m := map[string]interface{}{}
-	if err := d.Decode(&m); err != nil {
-		println(err.Error())
+	p := make([]byte, b64.DecodedLen(len(enc)))
 
+	n, err := b64.Decode(p, enc)
+	if err != nil || n < tagsz {
 		return nil
 	}
 
-	return m
+	return p[:n]
 }
 
-func Serialize(m map[string]interface{}) []byte {
-	b := &bytes.Buffer{}
+// requote adds n carets to every run of carets between a control string
+// introducer and a dash. Runs are never reduced to less than zero carets.
+func requote(b []byte, n int) []byte {
+	if bytes.IndexByte(b, '-') == -1 {
+		return b
+	}
 
-	inner := base64.NewEncoder(b64, b)
-	e := json.NewEncoder(inner)
+	r := make([]byte, 0, len(b)+bytes.Count(b, lbrace)*n)
 
-	if err := e.Encode(m); err != nil {
-		return nil
-	}
+	for i := 0; i < len(b); {
+		w := introducer(b[i:])
+		if w == 0 {
+			r = append(r, b[i])
+			i++
 
-	// Needed to flush base64 encoded data to buffer.
-	inner.Close()
+			continue
+		}
 
-	r := b.Bytes()
-	n := len(r)
+		r = append(r, b[i:i+w]...)
+		i += w
 
-	s := make([]byte, n+lpm+len(st))
+		j := i
+		for j < len(b) && b[j] == '^' {
+			j++
+		}
 
-	copy(s[:lpm], pm)
-	n += lpm
+		k := j - i
+		if j < len(b) && b[j] == '-' && k+n >= 0 {
+			k += n
+		}
 
-	copy(s[lpm:n], r)
-	copy(s[n:], st)
+		r = append(r, bytes.Repeat(caret, k)...)
+
+		i = j
+	}
 
-	return s
+	return r
 }
 
 //nolint:gochecknoglobals
 var (
-	b64 = base64.StdEncoding
-	lpm = len(pm)
+	b64   = base64.StdEncoding
+	caret = []byte{'^'}
 
-	// Control messages have the form: ESC^-{Base 64 encoded JSON}-ESC\.
-	pm = []byte{ESC, '^', '-', '{'}  // ESC ^ (PM) then "-{".
-	st = []byte{'}', '-', ESC, '\\'} // "}-" then ESC \ (ST).
+	errFraming = fmt.Errorf("%w: bad framing", ErrMalformed)
 )
@@ -37,13 +37,42 @@ func (c *Class) String() string {
 type T struct {
 	cls Class
 	raw []byte
-	kv  map[string]interface{}
+
+	// What a control message was read as, if not raw. See Scanned.
+	orig []byte
+
+	// The authentication tag and JSON of a control message. A control
+	// message read in binary framing is only framed if its bytes are
+	// needed.
+	body []byte
+
+	// Terminal ID from binary framing, if the message was addressed.
+	address string
+
+	// Control messages are decoded on first use.
+	ctl     Control
+	err     error
+	decoded bool
 }
 
 type message = T
 
-func Log(format string, i ...interface{}) *message {
-	return Raw(command("log", fmt.Sprintf(format, i...)))
+// Logf creates a log message.
+func Logf(format string, i ...interface{}) *message {
+	return From(Log{Text: fmt.Sprintf(format, i...)})
+}
+
+// As returns m's control message if it is of type C.
+func As[C Control](m *message) (C, bool) {
+	c, _ := m.Decode()
+	v, ok := c.(C)
+
+	return v, ok
+}
+
+// From creates a message from a control message.
+func From(c Control) *message {
+	return Raw(c.Bytes())
 }
 
 // New creates a new message of unparsed bytes.
@@ -58,31 +87,86 @@ func New(cls Class, raw []byte) *message {
 
 // Raw creates a message from raw bytes.
 func Raw(raw []byte) *message {
-	kv := Deserialize(raw)
-
 	cls := Text
-	if kv != nil {
+
+	body := payload(raw)
+	if body != nil {
 		cls = Command
 	}
 
 	c := &message{
-		cls: cls,
-		raw: raw,
-		kv:  kv,
+		body: body,
+		cls:  cls,
+		raw:  raw,
+	}
+
+	return c
+}
+
+// Scanned creates a control message, read as orig, from b. The message
+// may be in any carrier. It is reframed in its 7-bit carrier so that it
+// can be passed on. If the message turns out to be text, it is text as
+// read. See Original.
+func Scanned(b, orig []byte) *message {
+	c := &message{
+		cls:  Command,
+		orig: orig,
+		raw:  b,
+	}
+
+	if f, enc, _ := match(b, DCS8); enc != nil && f.Is8Bit() {
+		c.raw = f.sevenBit().frame(enc)
 	}
 
 	return c
 }
 
+// Address returns the ID of the terminal that the message was addressed
+// to in binary framing or the empty string if it was not addressed.
+func (m *message) Address() string {
+	return m.address
+}
+
 // Bytes returns the message's raw bytes.
 func (m *message) Bytes() []byte {
-	if m.raw == nil && m.kv != nil && m.Is(Command) {
-		m.raw = Serialize(m.kv)
+	if m.raw == nil && m.body != nil {
+		m.raw = frame(m.body)
 	}
 
 	return m.raw
 }
 
+// Original returns the bytes the message was read as. These only differ
+// from its raw bytes for a control message that was unwrapped or reframed
+// as it was read.
+func (m *message) Original() []byte {
+	if m.orig != nil {
+		return m.orig
+	}
+
+	return m.Bytes()
+}
+
+// Decode returns the message's control message. Text has no control
+// message. An error is returned if a control message is malformed.
+func (m *message) Decode() (Control, error) {
+	if !m.Is(Command) {
+		return nil, nil
+	}
+
+	if !m.decoded {
+		if p := m.contents(); p == nil {
+			m.err = errFraming
+		} else {
+			m.ctl, m.err = decode(p[tagsz:])
+		}
+
+		m.decoded = true
+	}
+
+	return m.ctl, m.err
+}
+
 // Is returns true if the message t is any of the classes in cs.
 func (m *message) Is(cs ...Class) bool {
 	if m == nil {
@@ -98,32 +182,31 @@ func (m *message) Is(cs ...Class) bool {
 	return false
 }
 
-// Parsed returns the message's parsed value.
-func (m *message) Parsed() map[string]interface{} {
-	if m.kv == nil && m.raw != nil && m.Is(Command) {
-		m.kv = Deserialize(m.raw)
-	}
-
-	return m.kv
-}
-
 // String returns the message's string representation. Useful for debugging.
 func (m *message) String() string {
-	cls := m.cls
+	cls := Text
+	s := strconv.Quote(string(m.Bytes()))
+
+	if m.contents() != nil {
+		cls = Command
 
-	kv := m.kv
-	if kv == nil {
-		kv = Deserialize(m.raw)
+		c, err := m.Decode()
+		if err != nil {
+			s = err.Error()
+		} else {
+			s = c.command() + fmt.Sprintf(" %+v", c)
+		}
 	}
 
-	s := strconv.Quote(string(m.raw))
+	return "(" + cls.String() + ": " + s + ")"
+}
 
-	if kv != nil {
-		cls = Command
-		s = fmt.Sprintf("%v", kv)
-	} else {
-		cls = Text
+// contents returns the authentication tag and JSON of a control message
+// or nil if m is not a control message.
+func (m *message) contents() []byte {
+	if m.body == nil && m.cls != Text {
+		m.body = payload(m.raw)
 	}
 
-	return "(" + cls.String() + ": " + s + ")"
+	return m.body
 }
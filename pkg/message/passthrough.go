@@ -0,0 +1,109 @@
+// Released under an MIT license. See LICENSE.
+
+package message
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Passthrough is a terminal multiplexer, between a mux and its parent,
+// that control messages must be wrapped to pass through. Both tmux and
+// GNU screen swallow control strings they don't understand but pass
+// through anything wrapped in a DCS string of their own.
+type Passthrough int
+
+// Passthroughs.
+const (
+	Direct Passthrough = iota // Nothing in between.
+	Screen                    // ESC P ... ESC \ in chunks.
+	Tmux                      // ESC P tmux; ... ESC \ with ESC doubled.
+)
+
+// ErrPassthrough is returned by ParsePassthrough for an unknown multiplexer.
+var ErrPassthrough = errors.New("unknown passthrough")
+
+// ParsePassthrough converts the name of a multiplexer ("screen" or
+// "tmux") to a passthrough. The empty string is Direct.
+func ParsePassthrough(s string) (Passthrough, error) {
+	for p, v := range passthroughs {
+		if v == s {
+			return Passthrough(p), nil
+		}
+	}
+
+	return Direct, fmt.Errorf("%w: %q", ErrPassthrough, s)
+}
+
+// String returns the name of the multiplexer.
+func (p Passthrough) String() string {
+	return passthroughs[p]
+}
+
+// Wrap returns b wrapped to pass through p, if b is a control message.
+// Anything else is returned unchanged.
+func (p Passthrough) Wrap(b []byte) []byte {
+	c, enc := split(b)
+	if enc == nil {
+		return b
+	}
+
+	switch p {
+	case Direct:
+		return b
+
+	case Screen:
+		return screen(c.eightBit().frame(enc))
+
+	case Tmux:
+		w := make([]byte, 0, len(b)+len(b)/2+len(dcs)+len(tmux)+len(st7))
+
+		w = append(w, dcs...)
+		w = append(w, tmux...)
+		w = append(w, bytes.ReplaceAll(b, dcs[:1], []byte{ESC, ESC})...)
+
+		return append(w, st7...)
+	}
+
+	return b
+}
+
+// screen wraps b, which must not contain an ESC, in as many DCS strings
+// as needed to stay under screen's limit on the length of a string.
+func screen(b []byte) []byte {
+	n := (len(b) + chunksz - 1) / chunksz
+
+	w := make([]byte, 0, len(b)+n*(len(dcs)+len(st7)))
+
+	for len(b) > 0 {
+		l := chunksz
+		if l > len(b) {
+			l = len(b)
+		}
+
+		w = append(w, dcs...)
+		w = append(w, b[:l]...)
+		w = append(w, st7...)
+
+		b = b[l:]
+	}
+
+	return w
+}
+
+// Screen strings are limited to 768 bytes.
+const chunksz = 512
+
+//nolint:gochecknoglobals
+var (
+	dcs  = []byte{ESC, 'P'}
+	st7  = []byte{ESC, '\\'}
+	tmux = []byte("tmux;")
+
+	passthroughs = [...]string{
+		Direct: "",
+		Screen: "screen",
+		Tmux:   "tmux",
+	}
+)
@@ -3,42 +3,96 @@
 // Package message encapsulates the units emitted by the lexer.
 package message
 
+func (m *message) IsAck() bool {
+	return is[*Ack](m)
+}
+
+func (m *message) IsAttach() bool {
+	return is[*Attach](m)
+}
+
+func (m *message) IsAttached() bool {
+	return is[*Attached](m)
+}
+
+func (m *message) IsBinary() bool {
+	return is[*Binary](m)
+}
+
+func (m *message) IsCapture() bool {
+	return is[*Capture](m)
+}
+
+func (m *message) IsChannel() bool {
+	return is[*Channel](m)
+}
+
+func (m *message) IsCredit() bool {
+	return is[*Credit](m)
+}
+
+func (m *message) IsError() bool {
+	return is[*Error](m)
+}
+
+func (m *message) IsHangup() bool {
+	return is[*Hangup](m)
+}
+
+func (m *message) IsHello() bool {
+	return is[*Hello](m)
+}
+
+func (m *message) IsList() bool {
+	return is[*List](m)
+}
+
 func (m *message) IsPty() bool {
-	return is(m, "pty")
+	return is[*Pty](m)
+}
+
+func (m *message) IsResolve() bool {
+	return is[*Resolve](m)
 }
 
 func (m *message) IsRun() bool {
-	return is(m, "run")
+	return is[*Run](m)
+}
+
+func (m *message) IsSecret() bool {
+	return is[*Secret](m)
+}
+
+func (m *message) IsShare() bool {
+	return is[*Share](m)
 }
 
 func (m *message) IsStarted() bool {
-	return is(m, "started")
+	return is[*Started](m)
 }
 
 func (m *message) IsStatus() bool {
-	return is(m, "status")
+	return is[*Status](m)
 }
 
 func (m *message) IsTerm() bool {
-	return is(m, "term")
+	return is[*Term](m)
+}
+
+func (m *message) IsTerminalSize() bool {
+	return is[*TerminalSize](m)
 }
 
 func (m *message) Logging() bool {
-	return is(m, "log")
+	return is[*Log](m)
 }
 
 func (m *message) Routing() bool {
-	return is(m, "pty", "term")
+	return m.IsChannel() || m.IsPty() || m.IsTerm()
 }
 
-func is(m *message, cmds ...string) bool {
-	s := m.Command()
-
-	for _, cmd := range cmds {
-		if s == cmd {
-			return true
-		}
-	}
+func is[C Control](m *message) bool {
+	_, ok := As[C](m)
 
-	return false
+	return ok
 }
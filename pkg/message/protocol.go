@@ -0,0 +1,46 @@
+// Released under an MIT license. See LICENSE.
+
+package message
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Version is the version of the protocol spoken by this build.
+// Peers must speak the same version.
+const Version = 3
+
+// Window is the number of text messages a session may send to its
+// terminal before it must wait for credit. Credit is granted as the
+// server delivers text so a slow terminal only pauses its own session.
+// Control messages are neither debited nor credited.
+const Window = 64
+
+// Capabilities lists the optional protocol features supported by this build.
+//
+//nolint:gochecknoglobals
+var Capabilities = []string{"auth", "binary", "carrier", "credit", "quote"}
+
+// Errors returned by Compatible.
+var (
+	ErrHello   = errors.New("expected hello")
+	ErrVersion = errors.New("protocol version mismatch")
+)
+
+// Compatible returns an error if m, the hello message sent by a peer,
+// shows that the peer does not speak this build's protocol.
+func Compatible(m *message) error {
+	c, _ := m.Decode()
+
+	h, ok := c.(*Hello)
+	if !ok {
+		return fmt.Errorf("%w: got %v", ErrHello, m)
+	}
+
+	if v := h.Version; v != Version {
+		return fmt.Errorf("%w: peer speaks %d, expected %d", ErrVersion, v, Version)
+	}
+
+	return nil
+}
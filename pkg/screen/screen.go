@@ -0,0 +1,924 @@
+// Released under an MIT license. See LICENSE.
+
+// Package screen keeps a model of what is on a terminal's screen so that
+// the screen can be redrawn or captured.
+//
+// The model understands the parts of VT100 and xterm that programs
+// commonly use: cursor movement, erasing, scrolling regions, inserting
+// and deleting, colors and attributes, and the alternate screen. Every
+// character is assumed to be one cell wide. Control strings (OSC, DCS,
+// PM, APC, and SOS) are ignored.
+package screen
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Attributes.
+const (
+	bold = 1 << iota
+	faint
+	italic
+	underline
+	blink
+	reverse
+	invisible
+	strike
+)
+
+// Colors are either the default (zero), an index into the palette, or
+// an RGB value.
+const (
+	palette = 1 << 24
+	rgb     = 2 << 24
+)
+
+// Parser states.
+const (
+	ground = iota
+	escape
+	charset
+	csi
+	str
+	strEscape
+)
+
+const (
+	maxParam  = 9999
+	maxParams = 16
+	tabstop   = 8
+)
+
+// T holds the state of a screen.
+type T struct {
+	cols, rows int
+
+	lines [][]cell
+	other [][]cell // The main screen while the alternate is shown.
+
+	alt      bool
+	autowrap bool
+	hidden   bool
+	insert   bool
+
+	pen pen
+	x   int
+	y   int
+
+	// Set when a character has been written to the last column.
+	wrap bool
+
+	// Scrolling region.
+	top    int
+	bottom int
+
+	saved cursor
+	tabs  []bool
+
+	last rune // For REP.
+
+	// Parser state.
+	intermediate bool
+	params       []int
+	partial      []byte
+	private      byte
+	state        int
+	osc          bool
+}
+
+type cell struct {
+	pen  pen
+	rune rune
+}
+
+type cursor struct {
+	pen  pen
+	x, y int
+}
+
+type pen struct {
+	attrs  uint8
+	bg, fg uint32
+}
+
+// New creates a screen with the given number of rows and columns. If
+// either is unknown (not positive), the screen is 24 rows by 80 columns.
+func New(rows, cols int) *T {
+	if rows <= 0 || cols <= 0 {
+		rows, cols = 24, 80
+	}
+
+	t := &T{}
+
+	t.reset(rows, cols)
+
+	return t
+}
+
+// Render returns the output that redraws the screen, as it is now, on a
+// terminal of the same size, whichever screen, main or alternate, that
+// terminal is showing.
+func (t *T) Render() []byte {
+	var sb strings.Builder
+
+	if t.alt {
+		sb.WriteString("\x1b[?1049h")
+	} else {
+		sb.WriteString("\x1b[?1049l")
+	}
+
+	sb.WriteString("\x1b[r\x1b[0m\x1b[H\x1b[2J")
+
+	current := pen{}
+
+	for y, line := range t.lines {
+		n := len(line)
+		for n > 0 && line[n-1] == (cell{}) {
+			n--
+		}
+
+		if n == 0 {
+			continue
+		}
+
+		sb.WriteString("\x1b[" + strconv.Itoa(y+1) + "H")
+
+		for _, c := range line[:n] {
+			if c.pen != current {
+				current = c.pen
+				sb.WriteString(current.sgr())
+			}
+
+			if c.rune == 0 {
+				sb.WriteByte(' ')
+			} else {
+				sb.WriteRune(c.rune)
+			}
+		}
+	}
+
+	if t.top != 0 || t.bottom != t.rows-1 {
+		sb.WriteString("\x1b[" + strconv.Itoa(t.top+1) + ";" + strconv.Itoa(t.bottom+1) + "r")
+	}
+
+	sb.WriteString(t.pen.sgr())
+	sb.WriteString("\x1b[" + strconv.Itoa(t.y+1) + ";" + strconv.Itoa(t.x+1) + "H")
+
+	if t.hidden {
+		sb.WriteString("\x1b[?25l")
+	}
+
+	if !t.autowrap {
+		sb.WriteString("\x1b[?7l")
+	}
+
+	if t.insert {
+		sb.WriteString("\x1b[4h")
+	}
+
+	return []byte(sb.String())
+}
+
+// Resize changes the size of the screen. When there are fewer rows,
+// lines are dropped from the top so that the cursor stays on screen.
+func (t *T) Resize(rows, cols int) {
+	if rows <= 0 || cols <= 0 || (rows == t.rows && cols == t.cols) {
+		return
+	}
+
+	drop := 0
+	if t.y >= rows {
+		drop = t.y - rows + 1
+	}
+
+	t.lines = resize(t.lines, drop, rows, cols)
+	if t.other != nil {
+		t.other = resize(t.other, 0, rows, cols)
+	}
+
+	tabs := make([]bool, cols)
+	copy(tabs, t.tabs)
+
+	for x := len(t.tabs); x < cols; x++ {
+		tabs[x] = x%tabstop == 0
+	}
+
+	t.cols, t.rows = cols, rows
+	t.tabs = tabs
+	t.top, t.bottom = 0, rows-1
+	t.wrap = false
+	t.x = clamp(t.x, 0, cols-1)
+	t.y = clamp(t.y-drop, 0, rows-1)
+	t.saved.x = clamp(t.saved.x, 0, cols-1)
+	t.saved.y = clamp(t.saved.y, 0, rows-1)
+}
+
+// Text returns the text on the screen. Trailing spaces and blank lines
+// are removed.
+func (t *T) Text() string {
+	lines := make([]string, 0, t.rows)
+
+	for _, line := range t.lines {
+		rs := make([]rune, len(line))
+		for i, c := range line {
+			rs[i] = c.rune
+			if c.rune == 0 {
+				rs[i] = ' '
+			}
+		}
+
+		lines = append(lines, strings.TrimRight(string(rs), " "))
+	}
+
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Write updates the screen with output written to the terminal.
+func (t *T) Write(b []byte) (int, error) {
+	for _, c := range b {
+		t.next(c)
+	}
+
+	return len(b), nil
+}
+
+func (t *T) blank() cell {
+	return cell{pen: pen{bg: t.pen.bg}}
+}
+
+func (t *T) control(c byte) {
+	switch c {
+	case '\b':
+		if t.x > 0 {
+			t.x--
+		}
+
+		t.wrap = false
+
+	case '\t':
+		t.tab(1)
+
+	case '\n', '\v', '\f':
+		t.linefeed()
+
+	case '\r':
+		t.x = 0
+		t.wrap = false
+	}
+}
+
+//nolint:cyclop,funlen,gocyclo
+func (t *T) dispatch(final byte) {
+	n := t.param(0, 1)
+
+	if t.private == '?' {
+		switch final {
+		case 'h', 'l':
+			for _, p := range t.params {
+				t.mode(p, final == 'h')
+			}
+		}
+
+		return
+	} else if t.private != 0 || t.intermediate {
+		return
+	}
+
+	t.wrap = false
+
+	switch final {
+	case '@':
+		line := t.lines[t.y]
+		n = clamp(n, 0, t.cols-t.x)
+		copy(line[t.x+n:], line[t.x:])
+		t.erase(t.y, t.x, t.x+n)
+
+	case 'A':
+		t.y = clamp(t.y-n, t.upper(), t.rows-1)
+
+	case 'B', 'e':
+		t.y = clamp(t.y+n, 0, t.lower())
+
+	case 'C', 'a':
+		t.x = clamp(t.x+n, 0, t.cols-1)
+
+	case 'D':
+		t.x = clamp(t.x-n, 0, t.cols-1)
+
+	case 'E':
+		t.x = 0
+		t.y = clamp(t.y+n, 0, t.lower())
+
+	case 'F':
+		t.x = 0
+		t.y = clamp(t.y-n, t.upper(), t.rows-1)
+
+	case 'G', '`':
+		t.x = clamp(n-1, 0, t.cols-1)
+
+	case 'H', 'f':
+		t.y = clamp(n-1, 0, t.rows-1)
+		t.x = clamp(t.param(1, 1)-1, 0, t.cols-1)
+
+	case 'I':
+		t.tab(n)
+
+	case 'J':
+		switch t.param(0, 0) {
+		case 0:
+			t.erase(t.y, t.x, t.cols)
+
+			for y := t.y + 1; y < t.rows; y++ {
+				t.erase(y, 0, t.cols)
+			}
+
+		case 1:
+			for y := 0; y < t.y; y++ {
+				t.erase(y, 0, t.cols)
+			}
+
+			t.erase(t.y, 0, t.x+1)
+
+		case 2, 3: //nolint:gomnd
+			for y := 0; y < t.rows; y++ {
+				t.erase(y, 0, t.cols)
+			}
+		}
+
+	case 'K':
+		switch t.param(0, 0) {
+		case 0:
+			t.erase(t.y, t.x, t.cols)
+
+		case 1:
+			t.erase(t.y, 0, t.x+1)
+
+		case 2: //nolint:gomnd
+			t.erase(t.y, 0, t.cols)
+		}
+
+	case 'L':
+		if t.y >= t.top && t.y <= t.bottom {
+			t.scrollDown(t.y, t.bottom, n)
+			t.x = 0
+		}
+
+	case 'M':
+		if t.y >= t.top && t.y <= t.bottom {
+			t.scrollUp(t.y, t.bottom, n)
+			t.x = 0
+		}
+
+	case 'P':
+		line := t.lines[t.y]
+		n = clamp(n, 0, t.cols-t.x)
+		copy(line[t.x:], line[t.x+n:])
+		t.erase(t.y, t.cols-n, t.cols)
+
+	case 'S':
+		t.scrollUp(t.top, t.bottom, n)
+
+	case 'T':
+		if len(t.params) <= 1 {
+			t.scrollDown(t.top, t.bottom, n)
+		}
+
+	case 'X':
+		t.erase(t.y, t.x, t.x+n)
+
+	case 'Z':
+		t.tab(-n)
+
+	case 'b':
+		if t.last != 0 {
+			for i := 0; i < n && i < t.cols*t.rows; i++ {
+				t.print(t.last)
+			}
+		}
+
+	case 'd':
+		t.y = clamp(n-1, 0, t.rows-1)
+
+	case 'g':
+		switch t.param(0, 0) {
+		case 0:
+			t.tabs[t.x] = false
+
+		case 3: //nolint:gomnd
+			for x := range t.tabs {
+				t.tabs[x] = false
+			}
+		}
+
+	case 'h', 'l':
+		for _, p := range t.params {
+			if p == 4 { //nolint:gomnd
+				t.insert = final == 'h'
+			}
+		}
+
+	case 'm':
+		t.sgr()
+
+	case 'r':
+		top := t.param(0, 1) - 1
+		bottom := t.param(1, t.rows) - 1
+
+		if bottom >= t.rows {
+			bottom = t.rows - 1
+		}
+
+		if top >= 0 && top < bottom {
+			t.top, t.bottom = top, bottom
+			t.x, t.y = 0, 0
+		}
+
+	case 's':
+		t.save()
+
+	case 'u':
+		t.restore()
+	}
+}
+
+func (t *T) erase(y, from, to int) {
+	from = clamp(from, 0, t.cols)
+	to = clamp(to, 0, t.cols)
+
+	blank := t.blank()
+	for x := from; x < to; x++ {
+		t.lines[y][x] = blank
+	}
+}
+
+func (t *T) esc(c byte) {
+	t.state = ground
+
+	switch c {
+	case '[':
+		t.intermediate = false
+		t.params = t.params[:0]
+		t.private = 0
+		t.state = csi
+
+	case ']', 'P', '^', '_', 'X':
+		t.osc = c == ']'
+		t.state = str
+
+	case '(', ')', '*', '+', '-', '.', '/', '#', '%', ' ':
+		t.state = charset
+
+	case '7':
+		t.save()
+
+	case '8':
+		t.restore()
+
+	case 'D':
+		t.linefeed()
+
+	case 'E':
+		t.x = 0
+		t.linefeed()
+
+	case 'H':
+		t.tabs[t.x] = true
+
+	case 'M':
+		t.wrap = false
+
+		if t.y == t.top {
+			t.scrollDown(t.top, t.bottom, 1)
+		} else if t.y > 0 {
+			t.y--
+		}
+
+	case 'c':
+		t.reset(t.rows, t.cols)
+	}
+}
+
+func (t *T) linefeed() {
+	t.wrap = false
+
+	if t.y == t.bottom {
+		t.scrollUp(t.top, t.bottom, 1)
+	} else if t.y < t.rows-1 {
+		t.y++
+	}
+}
+
+// The lower and upper methods return the limits of vertical movement.
+// The cursor can't be moved out of the scrolling region it is in.
+func (t *T) lower() int {
+	if t.y <= t.bottom {
+		return t.bottom
+	}
+
+	return t.rows - 1
+}
+
+func (t *T) mode(p int, set bool) {
+	switch p {
+	case 7: //nolint:gomnd
+		t.autowrap = set
+
+	case 25: //nolint:gomnd
+		t.hidden = !set
+
+	case 47, 1047, 1049: //nolint:gomnd
+		if set == t.alt {
+			return
+		}
+
+		if p == 1049 && set { //nolint:gomnd
+			t.save()
+		}
+
+		t.lines, t.other = t.other, t.lines
+		t.alt = set
+
+		if set {
+			if t.lines == nil {
+				t.lines = lines(t.rows, t.cols)
+			}
+
+			for y := 0; y < t.rows; y++ {
+				t.erase(y, 0, t.cols)
+			}
+		}
+
+		if p == 1049 && !set { //nolint:gomnd
+			t.restore()
+		}
+	}
+}
+
+//nolint:cyclop
+func (t *T) next(c byte) {
+	switch t.state {
+	case ground:
+		switch {
+		case c == '\x1b':
+			t.partial = t.partial[:0]
+			t.state = escape
+
+		case c < ' ':
+			t.partial = t.partial[:0]
+			t.control(c)
+
+		case c < utf8.RuneSelf:
+			t.partial = t.partial[:0]
+
+			if c != '\x7f' {
+				t.print(rune(c))
+			}
+
+		default:
+			t.partial = append(t.partial, c)
+			if utf8.FullRune(t.partial) || len(t.partial) == utf8.UTFMax {
+				r, _ := utf8.DecodeRune(t.partial)
+				t.partial = t.partial[:0]
+
+				if r != utf8.RuneError {
+					t.print(r)
+				}
+			}
+		}
+
+	case escape:
+		t.esc(c)
+
+	case charset:
+		t.state = ground
+
+	case csi:
+		switch {
+		case c == '\x1b':
+			t.state = escape
+
+		case c < ' ':
+			t.control(c)
+
+		case c >= '0' && c <= '9':
+			if len(t.params) == 0 {
+				t.params = append(t.params, 0)
+			}
+
+			if p := &t.params[len(t.params)-1]; *p < maxParam {
+				*p = *p*10 + int(c-'0') //nolint:gomnd
+			}
+
+		case c == ';' || c == ':':
+			if len(t.params) == 0 {
+				t.params = append(t.params, 0)
+			}
+
+			if len(t.params) < maxParams {
+				t.params = append(t.params, 0)
+			}
+
+		case c >= '<' && c <= '?':
+			if len(t.params) == 0 && t.private == 0 {
+				t.private = c
+			}
+
+		case c >= ' ' && c <= '/':
+			t.intermediate = true
+
+		case c >= '@' && c <= '~':
+			t.dispatch(c)
+			t.state = ground
+
+		default:
+			t.state = ground
+		}
+
+	case str:
+		if c == '\x1b' {
+			t.state = strEscape
+		} else if c == '\a' && t.osc {
+			t.state = ground
+		}
+
+	case strEscape:
+		if c == '\\' {
+			t.state = ground
+		} else if c != '\x1b' {
+			t.state = str
+		}
+	}
+}
+
+// param returns the ith parameter or dflt if it is missing or zero.
+func (t *T) param(i, dflt int) int {
+	if i < len(t.params) && t.params[i] != 0 {
+		return t.params[i]
+	}
+
+	return dflt
+}
+
+func (t *T) print(r rune) {
+	if t.wrap && t.autowrap {
+		t.x = 0
+		t.linefeed()
+	}
+
+	line := t.lines[t.y]
+
+	if t.insert {
+		copy(line[t.x+1:], line[t.x:])
+	}
+
+	line[t.x] = cell{pen: t.pen, rune: r}
+	t.last = r
+
+	if t.x < t.cols-1 {
+		t.x++
+	} else {
+		t.wrap = true
+	}
+}
+
+func (t *T) reset(rows, cols int) {
+	*t = T{
+		autowrap: true,
+		bottom:   rows - 1,
+		cols:     cols,
+		lines:    lines(rows, cols),
+		rows:     rows,
+		tabs:     make([]bool, cols),
+	}
+
+	for x := range t.tabs {
+		t.tabs[x] = x%tabstop == 0
+	}
+}
+
+func (t *T) restore() {
+	t.pen = t.saved.pen
+	t.x = t.saved.x
+	t.y = t.saved.y
+	t.wrap = false
+}
+
+func (t *T) save() {
+	t.saved = cursor{pen: t.pen, x: t.x, y: t.y}
+}
+
+// scrollDown moves lines top through bottom down by n.
+func (t *T) scrollDown(top, bottom, n int) {
+	n = clamp(n, 0, bottom-top+1)
+
+	copy(t.lines[top+n:bottom+1], t.lines[top:bottom+1-n])
+
+	for y := top; y < top+n; y++ {
+		t.lines[y] = make([]cell, t.cols)
+		t.erase(y, 0, t.cols)
+	}
+}
+
+// scrollUp moves lines top through bottom up by n.
+func (t *T) scrollUp(top, bottom, n int) {
+	n = clamp(n, 0, bottom-top+1)
+
+	copy(t.lines[top:bottom+1-n], t.lines[top+n:bottom+1])
+
+	for y := bottom + 1 - n; y <= bottom; y++ {
+		t.lines[y] = make([]cell, t.cols)
+		t.erase(y, 0, t.cols)
+	}
+}
+
+//nolint:cyclop
+func (t *T) sgr() {
+	if len(t.params) == 0 {
+		t.pen = pen{}
+
+		return
+	}
+
+	for i := 0; i < len(t.params); i++ {
+		switch p := t.params[i]; {
+		case p == 0:
+			t.pen = pen{}
+
+		case p >= 1 && p <= 9:
+			t.pen.attrs |= attributes[p]
+
+		case p == 21: //nolint:gomnd
+			t.pen.attrs |= underline
+
+		case p == 22: //nolint:gomnd
+			t.pen.attrs &^= bold | faint
+
+		case p >= 23 && p <= 29:
+			t.pen.attrs &^= attributes[p-20]
+
+		case p >= 30 && p <= 37:
+			t.pen.fg = palette | uint32(p-30)
+
+		case p == 38: //nolint:gomnd
+			t.pen.fg, i = t.color(i)
+
+		case p == 39: //nolint:gomnd
+			t.pen.fg = 0
+
+		case p >= 40 && p <= 47:
+			t.pen.bg = palette | uint32(p-40)
+
+		case p == 48: //nolint:gomnd
+			t.pen.bg, i = t.color(i)
+
+		case p == 49: //nolint:gomnd
+			t.pen.bg = 0
+
+		case p >= 90 && p <= 97:
+			t.pen.fg = palette | uint32(p-90+8)
+
+		case p >= 100 && p <= 107:
+			t.pen.bg = palette | uint32(p-100+8)
+		}
+	}
+}
+
+// color parses an extended color starting at the ith parameter. It
+// returns the color and the index of the last parameter used.
+func (t *T) color(i int) (uint32, int) {
+	switch t.param(i+1, 0) {
+	case 2: //nolint:gomnd
+		if i+4 < len(t.params) {
+			r, g, b := t.params[i+2]&0xff, t.params[i+3]&0xff, t.params[i+4]&0xff
+
+			return rgb | uint32(r<<16|g<<8|b), i + 4 //nolint:gomnd
+		}
+
+	case 5: //nolint:gomnd
+		if i+2 < len(t.params) {
+			return palette | uint32(t.params[i+2]&0xff), i + 2
+		}
+	}
+
+	return 0, len(t.params)
+}
+
+func (t *T) tab(n int) {
+	t.wrap = false
+
+	for ; n > 0 && t.x < t.cols-1; n-- {
+		for t.x++; t.x < t.cols-1 && !t.tabs[t.x]; t.x++ {
+		}
+	}
+
+	for ; n < 0 && t.x > 0; n++ {
+		for t.x--; t.x > 0 && !t.tabs[t.x]; t.x-- {
+		}
+	}
+}
+
+func (t *T) upper() int {
+	if t.y >= t.top {
+		return t.top
+	}
+
+	return 0
+}
+
+// sgr returns the SGR sequence that selects p.
+func (p pen) sgr() string {
+	s := "\x1b[0"
+
+	for i, a := range attributes {
+		if a != 0 && p.attrs&a != 0 {
+			s += ";" + strconv.Itoa(i)
+		}
+	}
+
+	s += color(p.fg, 30, 90, 38)  //nolint:gomnd
+	s += color(p.bg, 40, 100, 48) //nolint:gomnd
+
+	return s + "m"
+}
+
+// SGR parameters for each attribute.
+//
+//nolint:gochecknoglobals
+var attributes = [10]uint8{
+	1: bold,
+	2: faint,
+	3: italic,
+	4: underline,
+	5: blink,
+	7: reverse,
+	8: invisible,
+	9: strike,
+}
+
+func clamp(n, lo, hi int) int {
+	if n < lo {
+		return lo
+	} else if n > hi {
+		return hi
+	}
+
+	return n
+}
+
+func color(c uint32, base, bright, extended int) string {
+	switch {
+	case c&palette != 0 && c&0xff < 8:
+		return ";" + strconv.Itoa(base+int(c&0xff))
+
+	case c&palette != 0 && c&0xff < 16:
+		return ";" + strconv.Itoa(bright+int(c&0xff)-8)
+
+	case c&palette != 0:
+		return ";" + strconv.Itoa(extended) + ";5;" + strconv.Itoa(int(c&0xff))
+
+	case c&rgb != 0:
+		return ";" + strconv.Itoa(extended) + ";2;" +
+			strconv.Itoa(int(c>>16&0xff)) + ";" +
+			strconv.Itoa(int(c>>8&0xff)) + ";" +
+			strconv.Itoa(int(c&0xff))
+	}
+
+	return ""
+}
+
+func lines(rows, cols int) [][]cell {
+	ls := make([][]cell, rows)
+	for y := range ls {
+		ls[y] = make([]cell, cols)
+	}
+
+	return ls
+}
+
+func resize(ls [][]cell, drop, rows, cols int) [][]cell {
+	ls = ls[drop:]
+
+	if len(ls) > rows {
+		ls = ls[:rows]
+	}
+
+	for y, line := range ls {
+		if len(line) > cols {
+			ls[y] = line[:cols]
+		} else if len(line) < cols {
+			ls[y] = append(line, make([]cell, cols-len(line))...)
+		}
+	}
+
+	for len(ls) < rows {
+		ls = append(ls, make([]cell, cols))
+	}
+
+	return ls
+}
@@ -0,0 +1,120 @@
+// Released under an MIT license. See LICENSE.
+
+package screen_test
+
+import (
+	"testing"
+
+	"github.com/michaelmacinnis/summit/pkg/screen"
+)
+
+var writes = []struct {
+	name string
+	in   string
+	want string
+}{
+	// Printing and cursor movement.
+	{"wrap", "abcdefghijkl", "abcdefghij\nkl"},
+	{"newline", "ab\r\ncd", "ab\ncd"},
+	{"backspace", "abc\bx", "abx"},
+	{"tab", "a\tb", "a       b"},
+	{"position", "\x1b[3;4Hx", "\n\n   x"},
+	{"up and down", "\x1b[2Bx\x1b[Ay", "\n y\nx"},
+	{"back", "abc\x1b[2Dx", "axc"},
+	{"column", "abcdef\x1b[2Gx", "axcdef"},
+	{"next line", "ab\x1b[Ex", "ab\nx"},
+	{"clamped", "\x1b[99;99Hx\x1b[99Ay", "         y\n\n\n\n         x"},
+	{"save and restore", "ab\x1b7\x1b[3;1Hc\x1b8d", "abd\n\nc"},
+	{"repeat", "a\x1b[3b", "aaaa"},
+	{"no autowrap", "\x1b[?7labcdefghijkl", "abcdefghil"},
+	{"insert mode", "abc\x1b[1G\x1b[4hx", "xabc"},
+	{"attributes", "\x1b[1;31mred\x1b[0m \x1b[7mrev", "red rev"},
+	{"utf-8", "\xd0\x9f\xd1\x80\xd0\xb8", "При"},
+
+	// Erasing.
+	{"erase to end of line", "abcdef\x1b[3G\x1b[K", "ab"},
+	{"erase to start of line", "abcdef\x1b[3G\x1b[1K", "   def"},
+	{"erase line", "abcdef\x1b[2K", ""},
+	{"erase below", "ab\r\ncd\r\nef\x1b[2;2H\x1b[J", "ab\nc"},
+	{"erase above", "ab\r\ncd\r\nef\x1b[2;1H\x1b[1J", "\n d\nef"},
+	{"erase screen", "ab\r\ncd\x1b[2J", ""},
+	{"erase characters", "abcdef\x1b[1G\x1b[2X", "  cdef"},
+	{"delete characters", "abcdef\x1b[2G\x1b[2P", "adef"},
+	{"insert characters", "abcdef\x1b[2G\x1b[2@", "a  bcdef"},
+
+	// Scrolling.
+	{"scroll", "1\r\n2\r\n3\r\n4\r\n5\r\n6", "2\n3\n4\n5\n6"},
+	{"scroll up", "1\r\n2\r\n3\x1b[S", "2\n3"},
+	{"scroll down", "1\r\n2\r\n3\x1b[T", "\n1\n2\n3"},
+	{"region", "1\r\n2\r\n3\r\n4\r\n5\x1b[2;4r\x1b[4;1H\nx", "1\n3\n4\nx\n5"},
+	{"reverse index", "1\r\n2\r\n3\r\n4\r\n5\x1b[2;4r\x1b[2;1H\x1bMx", "1\nx\n2\n3\n5"},
+	{"insert lines", "a\r\nb\r\nc\x1b[2;1H\x1b[L", "a\n\nb\nc"},
+	{"delete lines", "a\r\nb\r\nc\x1b[1;1H\x1b[M", "b\nc"},
+	{"lines in region", "1\r\n2\r\n3\r\n4\r\n5\x1b[2;4r\x1b[2;1H\x1b[2M", "1\n4\n\n\n5"},
+
+	// The alternate screen.
+	{"alternate", "main\x1b[?1049h\x1b[Halt", "alt"},
+	{"main again", "main\x1b[?1049h\x1b[Halt\x1b[?1049lx", "mainx"},
+	{"alternate cleared", "\x1b[?1049ha\x1b[?1049l\x1b[?1049h", ""},
+
+	// Control strings are ignored.
+	{"osc", "a\x1b]0;title\ab", "ab"},
+	{"dcs", "a\x1bPdata\x1b\\b", "ab"},
+}
+
+func TestWrite(t *testing.T) {
+	for _, w := range writes {
+		s := screen.New(5, 10) //nolint:gomnd
+		s.Write([]byte(w.in))
+
+		if got := s.Text(); got != w.want {
+			t.Errorf("%s: got %q, want %q", w.name, got, w.want)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	for _, w := range writes {
+		s := screen.New(5, 10) //nolint:gomnd
+		s.Write([]byte(w.in))
+
+		fresh := screen.New(5, 10) //nolint:gomnd
+		fresh.Write(s.Render())
+
+		if got, want := fresh.Text(), s.Text(); got != want {
+			t.Errorf("%s: rendered %q, want %q", w.name, got, want)
+		}
+
+		if got, want := string(fresh.Render()), string(s.Render()); got != want {
+			t.Errorf("%s: rendered %q, want %q", w.name, got, want)
+		}
+	}
+}
+
+func TestResize(t *testing.T) {
+	tests := []struct {
+		name       string
+		in         string
+		rows, cols int
+		then       string
+		want       string
+	}{
+		{"fewer rows", "1\r\n2\r\n3\r\n4\r\n5", 3, 10, "", "3\n4\n5"},
+		{"fewer rows, cursor above", "1\r\n2\r\n3\x1b[H", 2, 10, "", "1\n2"},
+		{"fewer columns", "abcdefghij\r\nxyz", 5, 4, "", "abcd\nxyz"},
+		{"more", "ab", 6, 20, "\x1b[6;15Hz", "ab\n\n\n\n\n              z"},
+		{"region reset", "\x1b[2;3r", 6, 10, "\x1b[1;1Hx\x1b[6;1H\ny", "\n\n\n\n\ny"},
+		{"alternate", "main\x1b[?1049halt", 3, 2, "\x1b[?1049l", "ma"},
+	}
+
+	for _, test := range tests {
+		s := screen.New(5, 10) //nolint:gomnd
+		s.Write([]byte(test.in))
+		s.Resize(test.rows, test.cols)
+		s.Write([]byte(test.then))
+
+		if got := s.Text(); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
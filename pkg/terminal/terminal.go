@@ -30,10 +30,21 @@ func GetSize() *Size {
 	return ts
 }
 
+// Hangup sends SIGHUP to the process group led by p, as happens when a
+// terminal goes away.
+func Hangup(p *os.Process) error {
+	return unix.Kill(-p.Pid, unix.SIGHUP)
+}
+
 func IsTTY() bool {
 	return term.IsTerminal(int(stdin.Fd()))
 }
 
+// IsStdoutTTY returns true if stdout is a terminal.
+func IsStdoutTTY() bool {
+	return term.IsTerminal(int(os.Stdout.Fd()))
+}
+
 func MakeRaw() (func(), error) {
 	fd := int(stdin.Fd())
 